@@ -0,0 +1,188 @@
+package crpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lwch/crpc/encoding"
+)
+
+var errAuthRequired = errors.New("auth: authentication required")
+var errAuthTooLarge = errors.New("auth: message too large")
+
+// authVersion first byte of the handshake, it must not be an uppercase
+// letter, see network.Mux
+const authVersion = 2
+
+// 认证握手流程，每条消息均为Size(2) | Data，Data经过Encrypter加密
+//
+//	client -> server: Version(1) | Hello
+//	server -> client: Challenge(32)
+//	client -> server: Credential
+//	server -> client: Status(1) | Error Message
+
+// AuthInfo authentication info of a new connection
+type AuthInfo struct {
+	RemoteAddr net.Addr
+	// Challenge random bytes generated by the server for the connection
+	Challenge []byte
+	// Credential credential sent by the client
+	Credential []byte
+}
+
+// AuthenticateFunc verifies the connection and returns its identity,
+// returning an error rejects the connection
+type AuthenticateFunc func(AuthInfo) (any, error)
+
+// Credentials client credentials, they are sent on every connect and
+// reconnect
+type Credentials interface {
+	// Credential returns the credential answering the server challenge
+	Credential(challenge []byte) ([]byte, error)
+}
+
+// TokenCredentials sends the token as the credential
+type TokenCredentials string
+
+// Credential returns the token
+func (token TokenCredentials) Credential([]byte) ([]byte, error) {
+	return []byte(token), nil
+}
+
+// HMACCredentials answers the challenge with hmac-sha256 of the key, so
+// the key itself is never sent, see VerifyHMAC
+type HMACCredentials []byte
+
+// Credential returns hmac-sha256 of the challenge
+func (key HMACCredentials) Credential(challenge []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	return mac.Sum(nil), nil
+}
+
+// VerifyHMAC reports whether the credential is answered by HMACCredentials
+// with the key
+func VerifyHMAC(info AuthInfo, key []byte) bool {
+	want, _ := HMACCredentials(key).Credential(info.Challenge)
+	return hmac.Equal(want, info.Credential)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of the connection returned by
+// ServerConfig.Authenticate, the context is from an incoming request or
+// Stream.Context
+func IdentityFromContext(ctx context.Context) any {
+	return ctx.Value(identityKey{})
+}
+
+func writeAuth(w io.Writer, encrypter encoding.Encrypter, prefix, data []byte) error {
+	var err error
+	if encrypter != nil {
+		data, err = encrypter.Encrypt(data)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) > 65535 {
+		return errAuthTooLarge
+	}
+	buf := append(prefix, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(prefix):], uint16(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+func readAuth(r io.Reader, encrypter encoding.Encrypter) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if encrypter == nil {
+		return data, nil
+	}
+	return encrypter.Decrypt(data)
+}
+
+// clientAuth runs the client side of the authentication handshake
+func clientAuth(conn net.Conn, encrypter encoding.Encrypter, cred Credentials) error {
+	if err := writeAuth(conn, encrypter, []byte{authVersion}, nil); err != nil {
+		return err
+	}
+	challenge, err := readAuth(conn, encrypter)
+	if err != nil {
+		return err
+	}
+	data, err := cred.Credential(challenge)
+	if err != nil {
+		return err
+	}
+	if err := writeAuth(conn, encrypter, nil, data); err != nil {
+		return err
+	}
+	status, err := readAuth(conn, encrypter)
+	if err != nil {
+		return err
+	}
+	if len(status) == 0 || status[0] != 0 {
+		if len(status) > 0 {
+			status = status[1:]
+		}
+		return fmt.Errorf("auth: rejected: %s", status)
+	}
+	return nil
+}
+
+// serverAuth runs the server side of the authentication handshake and
+// returns the identity of the connection, accept is called with the
+// identity before the status is sent, its error rejects the connection
+func serverAuth(conn net.Conn, encrypter encoding.Encrypter, fn AuthenticateFunc, accept func(any) error) (any, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return nil, err
+	}
+	if version[0] != authVersion {
+		return nil, errAuthRequired
+	}
+	if _, err := readAuth(conn, encrypter); err != nil {
+		return nil, err
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if err := writeAuth(conn, encrypter, nil, challenge); err != nil {
+		return nil, err
+	}
+	cred, err := readAuth(conn, encrypter)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := fn(AuthInfo{
+		RemoteAddr: conn.RemoteAddr(),
+		Challenge:  challenge,
+		Credential: cred,
+	})
+	if err == nil {
+		err = accept(identity)
+	}
+	if err != nil {
+		writeAuth(conn, encrypter, nil, append([]byte{1}, err.Error()...))
+		return nil, err
+	}
+	if err := writeAuth(conn, encrypter, nil, []byte{0}); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
@@ -0,0 +1,91 @@
+package crpc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	key := []byte("crpc auth key")
+	_, addr := newTestServer(t, ServerConfig{
+		Authenticate: func(info AuthInfo) (any, error) {
+			if !VerifyHMAC(info, key) {
+				return nil, errors.New("invalid key")
+			}
+			return "alice", nil
+		},
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			return reply(fmt.Sprint(IdentityFromContext(r.Context())))(r)
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Credentials: HMACCredentials(key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	identity, err := call(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != "alice" {
+		t.Fatalf("unexpected identity: %s", identity)
+	}
+	_, err = NewClientWithConfig(addr, ClientConfig{
+		Credentials: HMACCredentials("wrong key"),
+	})
+	if err == nil {
+		t.Fatal("client with wrong key connected")
+	}
+}
+
+func TestCloseDuringHandshake(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	svr, addr := newTestServer(t, ServerConfig{
+		Authenticate: func(info AuthInfo) (any, error) {
+			// the handshake of the reconnect hangs until the client is closed
+			if calls.Add(1) == 2 {
+				close(started)
+				<-release
+			}
+			return nil, nil
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Credentials: TokenCredentials("token"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is registered after the client is connected
+	var sessions []*Session
+	for i := 0; len(sessions) == 0; i++ {
+		if i > 100 {
+			t.Fatal("session not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		sessions = svr.Sessions().List(nil)
+	}
+	if err := svr.Sessions().Kick(sessions[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cli.Close()
+	release <- struct{}{}
+	// give the server the time to finish the handshake
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; svr.Sessions().Len() != 0; i++ {
+		if i > 100 {
+			t.Fatal("session of the closed client still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
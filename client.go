@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/lwch/crpc/encoding"
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/encrypt"
+	"github.com/lwch/crpc/internal/proxy"
 	"github.com/lwch/logging"
 )
 
@@ -19,61 +23,248 @@ var ErrReconnecting = errors.New("reconnecting")
 // ErrClosed closed error
 var ErrClosed = errors.New("closed")
 
+// handshakeTimeout timeout of the handshakes before the transport starts
+const handshakeTimeout = 10 * time.Second
+
 // Client rpc client
 type Client struct {
 	sync.RWMutex
-	addr string
-	tp   *transport
+	addr        string
+	proxy       func(string) (*url.URL, error)
+	dialFn      func(context.Context, string) (net.Conn, error)
+	onRequest   RequestHandlerFunc
+	onAccept    AcceptStreamHandlerFunc
+	keyExchange *encrypt.Exchange
+	credentials Credentials
+	limits      Limits
+	encrypter   encoding.Encrypter
+	compresser  encoding.Compresser
+	codec       encoding.Codec
+	named       bool
+	codecCfg    codec.Config
+	tp          *transport
 	// runtime
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+// ClientConfig client config
+type ClientConfig struct {
+	Encrypter  encoding.Encrypter
+	Compresser encoding.Compresser
+	// Proxy returns the proxy for the given address, a nil url means
+	// dial directly, see ProxyURL and ProxyFromEnvironment
+	Proxy func(addr string) (*url.URL, error)
+	// Dial custom dialer, e.g. rudp for lossy links, Proxy is ignored
+	// when set, returning ErrClosed stops reconnecting
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+	// OnRequest serves the requests called by the server, see Session
+	OnRequest RequestHandlerFunc
+	// OnAccept serves the streams opened by the server, they are refused
+	// when nil
+	OnAccept AcceptStreamHandlerFunc
+	// KeyExchange runs an x25519 key exchange on every connect and
+	// reconnect, the session keys replace Encrypter
+	KeyExchange *encrypt.Exchange
+	// Credentials are sent to ServerConfig.Authenticate on every connect
+	// and reconnect
+	Credentials Credentials
+	// Limits resource limits of the connection
+	Limits Limits
+	// Codec replaces the default codec, see ServerConfig.Codec
+	Codec encoding.Codec
+	// CodecConfig config of the default codec, see
+	// ServerConfig.CodecConfig
+	CodecConfig codec.Config
+	// NamedStreams must match ServerConfig.NamedStreams, it is required
+	// by OpenNamedStream
+	NamedStreams bool
+}
+
+// ProxyURL returns a proxy func that always returns the given url,
+// supported schemes are http, https, socks5 and socks5h, socks5 resolves
+// the host locally and socks5h by the proxy, the user info of the url is
+// used for proxy authentication
+func ProxyURL(u *url.URL) func(string) (*url.URL, error) {
+	return func(string) (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// ProxyFromEnvironment returns the proxy from HTTPS_PROXY or ALL_PROXY
+// environment variables, addresses matched by NO_PROXY are dialed directly
+func ProxyFromEnvironment(addr string) (*url.URL, error) {
+	return proxy.FromEnvironment(addr)
+}
+
 // NewClient create client
 func NewClient(addr string) (*Client, error) {
-	conn, err := dial(addr, 1)
-	if err != nil {
-		return nil, err
-	}
+	return NewClientWithConfig(addr, ClientConfig{})
+}
+
+// NewClientWithConfig create client with config
+func NewClientWithConfig(addr string, cfg ClientConfig) (*Client, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cli := &Client{
-		addr:   addr,
-		tp:     new(conn),
-		ctx:    ctx,
-		cancel: cancel,
+		addr:        addr,
+		proxy:       cfg.Proxy,
+		dialFn:      cfg.Dial,
+		onRequest:   cfg.OnRequest,
+		onAccept:    cfg.OnAccept,
+		keyExchange: cfg.KeyExchange,
+		credentials: cfg.Credentials,
+		limits:      cfg.Limits,
+		encrypter:   cfg.Encrypter,
+		compresser:  cfg.Compresser,
+		codec:       cfg.Codec,
+		named:       cfg.NamedStreams,
+		codecCfg:    cfg.CodecConfig,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	conn, encrypter, err := cli.dial(1)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
+	cli.tp = cli.newTransport(conn, encrypter)
 	go cli.serve()
 	return cli, nil
 }
 
 // SetEncrypter set encrypter
 func (cli *Client) SetEncrypter(encrypter encoding.Encrypter) {
-	cli.tp.SetEncrypter(encrypter)
+	cli.Lock()
+	defer cli.Unlock()
+	cli.encrypter = encrypter
+	if cli.tp != nil && cli.keyExchange == nil {
+		cli.tp.SetEncrypter(encrypter)
+	}
 }
 
 // SetCompresser set compresser
 func (cli *Client) SetCompresser(compresser encoding.Compresser) {
-	cli.tp.SetCompresser(compresser)
+	cli.Lock()
+	defer cli.Unlock()
+	cli.compresser = compresser
+	if cli.tp != nil {
+		cli.tp.SetCompresser(compresser)
+	}
 }
 
-func dial(addr string, retry int) (net.Conn, error) {
+// dial dial and run the handshakes, returns the encrypter of the
+// connection
+func (cli *Client) dial(retry int) (net.Conn, encoding.Encrypter, error) {
 	for i := 0; retry == 0 || i < retry; i++ {
-		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		select {
+		case <-cli.ctx.Done():
+			return nil, nil, ErrClosed
+		default:
+		}
+		conn, err := cli.dialOnce()
 		if err == nil {
-			return conn, nil
+			var encrypter encoding.Encrypter
+			encrypter, err = cli.handshake(conn)
+			if err == nil {
+				return conn, encrypter, nil
+			}
+			conn.Close()
+		}
+		if errors.Is(err, ErrClosed) {
+			return nil, nil, err
 		}
+		logging.Error("dial %s: %v", cli.addr, err)
 		time.Sleep(time.Second)
 	}
-	return nil, fmt.Errorf("transport: dial more than %d times", retry)
+	return nil, nil, fmt.Errorf("transport: dial more than %d times", retry)
+}
+
+// handshake run the handshakes on conn, it is aborted with ErrClosed when
+// the client is closed
+func (cli *Client) handshake(conn net.Conn) (encoding.Encrypter, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	stop := context.AfterFunc(cli.ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	encrypter, err := cli.runHandshake(conn)
+	if !stop() {
+		return nil, ErrClosed
+	}
+	return encrypter, err
+}
+
+func (cli *Client) runHandshake(conn net.Conn) (encoding.Encrypter, error) {
+	cli.RLock()
+	encrypter := cli.encrypter
+	cli.RUnlock()
+	if cli.keyExchange != nil {
+		enc, err := cli.keyExchange.Handshake(conn, encrypt.RoleClient)
+		if err != nil {
+			return nil, fmt.Errorf("key exchange: %w", err)
+		}
+		encrypter = enc
+	}
+	if cli.credentials != nil {
+		err := clientAuth(conn, cloneEncrypter(encrypter), cli.credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encrypter, nil
+}
+
+func (cli *Client) dialOnce() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(cli.ctx, 3*time.Second)
+	defer cancel()
+	if cli.dialFn != nil {
+		return cli.dialFn(ctx, cli.addr)
+	}
+	if cli.proxy != nil {
+		u, err := cli.proxy(cli.addr)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return proxy.Dial(ctx, u, cli.addr)
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", cli.addr)
+}
+
+func (cli *Client) newTransport(conn net.Conn, encrypter encoding.Encrypter) *transport {
+	tp := new(conn)
+	tp.namedStreams = cli.named
+	tp.codecConfig = cli.codecCfg
+	tp.SetLimits(cli.limits)
+	tp.SetCodec(cli.codec)
+	tp.SetEncrypter(encrypter)
+	cli.RLock()
+	tp.SetCompresser(cli.compresser)
+	cli.RUnlock()
+	if cli.onRequest != nil {
+		tp.SetOnRequest(cli.onRequest)
+	}
+	go tp.acceptStreams(cli.onAccept, nil)
+	return tp
+}
+
+// Done returns a channel that is closed when the client is closed
+func (cli *Client) Done() <-chan struct{} {
+	return cli.ctx.Done()
 }
 
 // Close close client
 func (cli *Client) Close() error {
+	// cancel first, serve does not publish a transport after the cancel
+	cli.cancel()
 	var err error
-	if cli.tp != nil {
-		err = cli.tp.Close()
+	cli.RLock()
+	tp := cli.tp
+	cli.RUnlock()
+	if tp != nil {
+		err = tp.Close()
 	}
-	cli.cancel()
 	return err
 }
 
@@ -89,20 +280,26 @@ func (cli *Client) serve() error {
 		if err != nil {
 			logging.Error("serve %s: %v", cli.addr, err)
 		}
-		encrypter := cli.tp.encrypter
-		compresser := cli.tp.compresser
 		cli.Lock()
 		cli.tp.Close()
 		cli.tp = nil
 		cli.Unlock()
-		conn, err := dial(cli.addr, 0)
+		conn, encrypter, err := cli.dial(0)
 		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				return err
+			}
 			continue
 		}
-		tp := new(conn)
-		tp.SetEncrypter(encrypter)
-		tp.SetCompresser(compresser)
+		tp := cli.newTransport(conn, encrypter)
 		cli.Lock()
+		// Close may run during the handshakes, it does not see this
+		// transport
+		if cli.ctx.Err() != nil {
+			cli.Unlock()
+			tp.Close()
+			return ErrClosed
+		}
 		cli.tp = tp
 		cli.Unlock()
 	}
@@ -126,6 +323,13 @@ func (cli *Client) Call(ctx context.Context, req *http.Request) (*http.Response,
 
 // OpenStream open stream
 func (cli *Client) OpenStream(ctx context.Context) (*Stream, error) {
+	return cli.OpenNamedStream(ctx, "")
+}
+
+// OpenNamedStream open stream with name, the name is checked by the
+// server Policy, ErrStreamRefused is returned when it is refused. It
+// requires ClientConfig.NamedStreams.
+func (cli *Client) OpenNamedStream(ctx context.Context, name string) (*Stream, error) {
 	select {
 	case <-cli.ctx.Done():
 		return nil, ErrClosed
@@ -137,5 +341,5 @@ func (cli *Client) OpenStream(ctx context.Context) (*Stream, error) {
 	if tp == nil {
 		return nil, ErrReconnecting
 	}
-	return tp.OpenStream(ctx)
+	return tp.OpenStream(ctx, name)
 }
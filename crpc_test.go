@@ -0,0 +1,165 @@
+package crpc
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc/encoding/encrypt"
+)
+
+func reply(body string) RequestHandlerFunc {
+	return func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+}
+
+func call(cli *Client) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/ping", nil)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rep, err := cli.Call(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(rep.Body)
+	return string(data), err
+}
+
+// newTestServer serve cfg on a random local port, the server is closed
+// when the test finishes
+func newTestServer(t *testing.T, cfg ServerConfig) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(cfg)
+	t.Cleanup(func() { svr.Close() })
+	go svr.Serve(l)
+	return svr, l.Addr().String()
+}
+
+func TestKeyExchange(t *testing.T) {
+	psk := encrypt.KeyFromPassphrase("crpc psk", []byte("crpc salt"), 1000)
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRing := func(key string) *encrypt.KeyRing {
+		ring := encrypt.NewKeyRing()
+		ring.Add(1, encrypt.New(encrypt.AesGCM, encrypt.KeyFromPassphrase(key, []byte("crpc salt"), 1000), encrypt.RoleServer))
+		return ring
+	}
+	cfg := ServerConfig{
+		KeyExchange: &encrypt.Exchange{PSK: psk, PrivateKey: priv},
+		Encrypter:   keyRing("crpc key"),
+		// the credentials are sent after the key exchange
+		Authenticate: func(info AuthInfo) (any, error) {
+			return string(info.Credential), nil
+		},
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			return reply(IdentityFromContext(r.Context()).(string))(r)
+		},
+		OnAccept: echo,
+	}
+	svr, addr := newTestServer(t, cfg)
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		KeyExchange: &encrypt.Exchange{PSK: psk, ServerPublicKey: priv.PublicKey()},
+		Credentials: TokenCredentials("alice"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// the session keys are not replaced
+	other := encrypt.KeyFromPassphrase("other key", []byte("crpc salt"), 1000)
+	cli.SetEncrypter(encrypt.New(encrypt.AesGCM, other, encrypt.RoleClient))
+	identity, err := call(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != "alice" {
+		t.Fatalf("unexpected identity: %s", identity)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping(t, s, "hello")
+	s.Close()
+	// the key rings of the config do not replace the session keys
+	cfg.Encrypter = keyRing("next key")
+	if err := svr.UpdateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call(cli); err != nil {
+		t.Fatal(err)
+	}
+	// the reconnect runs a new key exchange
+	first := svr.Sessions().List(nil)[0]
+	if err := svr.Sessions().Kick(first.ID()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		sessions := svr.Sessions().List(nil)
+		if len(sessions) == 1 && sessions[0].ID() != first.ID() {
+			break
+		}
+		if i > 300 {
+			t.Fatal("client not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the client may not have published the new transport yet
+	for i := 0; ; i++ {
+		_, err := call(cli)
+		if err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyExchangeMismatch(t *testing.T) {
+	psk := encrypt.KeyFromPassphrase("crpc psk", []byte("crpc salt"), 1000)
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, ServerConfig{
+		KeyExchange: &encrypt.Exchange{PSK: psk, PrivateKey: priv},
+		OnRequest:   reply("pong"),
+	})
+	other := encrypt.KeyFromPassphrase("other psk", []byte("crpc salt"), 1000)
+	for name, ex := range map[string]*encrypt.Exchange{
+		"psk":        {PSK: other, ServerPublicKey: priv.PublicKey()},
+		"server key": {PSK: psk, ServerPublicKey: fake.PublicKey()},
+	} {
+		cli, err := NewClientWithConfig(addr, ClientConfig{KeyExchange: ex})
+		if err == nil {
+			cli.Close()
+			t.Fatalf("%s: client with wrong key connected", name)
+		}
+	}
+}
@@ -11,21 +11,70 @@ import (
 	"github.com/lwch/crpc/encoding"
 	"github.com/lwch/crpc/internal/join"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 var errUnsupportedType = errors.New("codec: unsupported type")
 var errIsNotPointer = errors.New("codec: the specify variable is not pointer")
 var errProtoMessage = errors.New("codec: the specify variable is not proto.Message")
+var errMessageName = errors.New("codec: invalid message name")
+
+// ErrHeaderTooLarge http header is larger than Config.MaxHeaderBytes
+var ErrHeaderTooLarge = errors.New("codec: http header too large")
+
+// ErrTooManyHeaders http header has more lines than Config.MaxHeaderCount
+var ErrTooManyHeaders = errors.New("codec: too many http headers")
+
+// DefaultMaxHeaderCount default max number of http header lines
+const DefaultMaxHeaderCount = 256
+
+// Config codec config
+type Config struct {
+	// MaxHeaderBytes max size of http headers, zero means
+	// http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// MaxHeaderCount max number of http header lines, zero means
+	// DefaultMaxHeaderCount
+	MaxHeaderCount int
+	// Resolver finds the protobuf message types decoded into *any, nil
+	// means protoregistry.GlobalTypes
+	Resolver protoregistry.MessageTypeResolver
+	// MaxFrameSize max size of a message read by Decoder, zero means
+	// DefaultMaxFrameSize
+	MaxFrameSize int
+	// LegacyProtobuf sends proto messages as TypeProtobuf without the
+	// message name for the peers of older versions, TypeNamedProtobuf is
+	// sent by default so that the receivers can decode into *any
+	LegacyProtobuf bool
+}
 
 // Codec serializer
 type Codec struct {
+	cfg      Config
 	bufPool  sync.Pool
 	joinPool sync.Pool
 }
 
 // New create codec
 func New() encoding.Codec {
-	c := &Codec{}
+	return NewWithConfig(Config{})
+}
+
+// NewWithConfig create codec with config
+func NewWithConfig(cfg Config) encoding.Codec {
+	if cfg.MaxHeaderBytes <= 0 {
+		cfg.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if cfg.MaxHeaderCount <= 0 {
+		cfg.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = protoregistry.GlobalTypes
+	}
+	c := &Codec{cfg: cfg}
 	c.bufPool.New = func() any {
 		return new(join.BytesBuffer)
 	}
@@ -35,7 +84,10 @@ func New() encoding.Codec {
 	return c
 }
 
-// Marshal serialize data
+// Marshal serialize data, values of the types not supported by crpc or
+// registered are encoded as json rather than rejected with an unsupported
+// type error, the error of encoding/json is returned for the values json
+// does not support, e.g. channels and funcs
 func (c *Codec) Marshal(v any) ([]byte, error) {
 	switch value := v.(type) {
 	case []byte:
@@ -47,7 +99,10 @@ func (c *Codec) Marshal(v any) ([]byte, error) {
 	case proto.Message:
 		return c.marshalProtoMessage(value)
 	default:
-		return nil, errUnsupportedType
+		if id, t, ok := lookup(v); ok {
+			return c.marshalRegistered(id, t, v)
+		}
+		return c.marshalJSON(v)
 	}
 }
 
@@ -68,12 +123,25 @@ func (c *Codec) Unmarshal(data []byte, v any) (int, error) {
 	case TypeRaw:
 		return c.unmarshalRaw(r, v, len(data)-1)
 	case TypeHTTPRequest:
+		if err := c.checkHeader(data[1:]); err != nil {
+			return 0, err
+		}
 		return c.unmarshalHTTPRequest(r, v)
 	case TypeHTTPResponse:
+		if err := c.checkHeader(data[1:]); err != nil {
+			return 0, err
+		}
 		return c.unmarshalHTTPResponse(r, v)
 	case TypeProtobuf:
 		return c.unmarshalProtoMessage(r, v)
+	case TypeJSON:
+		return c.unmarshalJSON(r, v)
+	case TypeNamedProtobuf:
+		return c.unmarshalNamedProtoMessage(r, v)
 	default:
+		if t, ok := registered(hdr.Type); ok {
+			return c.unmarshalRegistered(t, data[1:], v)
+		}
 		return 0, errUnsupportedType
 	}
 }
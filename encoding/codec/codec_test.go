@@ -1,12 +1,16 @@
 package codec
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
 
 	"github.com/lwch/crpc/test_data/pb"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestRequest(t *testing.T) {
@@ -163,3 +167,141 @@ func TestProtobuf(t *testing.T) {
 		t.Fatal("invalid args")
 	}
 }
+
+func TestHeaderLimit(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		req.Header.Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("a", 100))
+	}
+	data, err := New().Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newReq http.Request
+	if _, err := NewWithConfig(Config{MaxHeaderCount: 5}).Unmarshal(data, &newReq); err != ErrTooManyHeaders {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewWithConfig(Config{MaxHeaderBytes: 512}).Unmarshal(data, &newReq); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := New().Unmarshal(data, &newReq); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type point struct {
+	X, Y int32
+}
+
+func TestRegister(t *testing.T) {
+	err := Register(TypeUser, Type{
+		Match: func(v any) bool {
+			_, ok := v.(*point)
+			return ok
+		},
+		Marshal: func(v any) ([]byte, error) {
+			p := v.(*point)
+			return binary.BigEndian.AppendUint32(
+				binary.BigEndian.AppendUint32(nil, uint32(p.X)), uint32(p.Y)), nil
+		},
+		Unmarshal: func(data []byte, v any) error {
+			p, ok := v.(*point)
+			if !ok || len(data) != 8 {
+				return fmt.Errorf("invalid point")
+			}
+			p.X = int32(binary.BigEndian.Uint32(data))
+			p.Y = int32(binary.BigEndian.Uint32(data[4:]))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregister(TypeUser) })
+	if err := Register(TypeUser, Type{}); err == nil {
+		t.Fatal("registered invalid type")
+	}
+	if err := Register(TypeProtobuf, Type{}); err == nil {
+		t.Fatal("registered reserved type")
+	}
+	c := New()
+	data, err := c.Marshal(&point{X: 1, Y: -2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p point
+	if _, err := c.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.X != 1 || p.Y != -2 {
+		t.Fatalf("unexpected point: %+v", p)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	c := New()
+	data, err := c.Marshal(user{Name: "alice", Age: 18})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u user
+	if _, err := c.Unmarshal(data, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "alice" || u.Age != 18 {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+	var v any
+	if _, err := c.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok || m["name"] != "alice" || m["age"] != float64(18) {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
+func TestProtobufAny(t *testing.T) {
+	legacy, err := NewWithConfig(Config{LegacyProtobuf: true}).Marshal(&pb.Request{Id: 1, Uri: "/ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DataType(legacy[0]) != TypeProtobuf {
+		t.Fatalf("unexpected legacy data type: %d", legacy[0])
+	}
+	c := New()
+	buf, err := c.Marshal(&pb.Request{Id: 1, Uri: "/ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v any
+	if _, err := c.Unmarshal(buf, &v); err != nil {
+		t.Fatal(err)
+	}
+	req, ok := v.(*pb.Request)
+	if !ok {
+		t.Fatalf("unexpected type: %T", v)
+	}
+	if req.Id != 1 || req.Uri != "/ping" {
+		t.Fatal("invalid request")
+	}
+	var str wrapperspb.StringValue
+	if _, err := c.Unmarshal(buf, &str); err == nil {
+		t.Fatal("decoded into another message type")
+	}
+	var named pb.Request
+	if _, err := New().Unmarshal(buf, &named); err != nil || named.Uri != "/ping" {
+		t.Fatalf("decode named message by default: %v", err)
+	}
+	c = NewWithConfig(Config{Resolver: new(protoregistry.Types)})
+	if _, err := c.Unmarshal(buf, &v); err == nil {
+		t.Fatal("decoded unknown message type")
+	}
+}
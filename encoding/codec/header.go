@@ -14,6 +14,11 @@ const (
 	TypeHTTPResponse
 	// TypeProtobuf protobuf data
 	TypeProtobuf
+	// TypeJSON json data of any other value
+	TypeJSON
+	// TypeNamedProtobuf protobuf data with its full message name, it is
+	// sent unless Config.LegacyProtobuf is set
+	TypeNamedProtobuf
 )
 
 type header struct {
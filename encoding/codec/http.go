@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net/http"
 	"reflect"
@@ -80,3 +81,20 @@ func (c *Codec) unmarshalHTTPResponse(r io.Reader, v any) (int, error) {
 	reflect.ValueOf(v).Elem().Set(reflect.ValueOf(resp))
 	return 0, nil
 }
+
+// checkHeader check the size and number of lines of the http header
+// before parsing it
+func (c *Codec) checkHeader(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(data)
+	}
+	if end > c.cfg.MaxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	// the first line is the request or status line
+	if bytes.Count(data[:end], []byte("\n")) > c.cfg.MaxHeaderCount {
+		return ErrTooManyHeaders
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package codec
+
+import (
+	"encoding/json"
+	"io"
+)
+
+func (*Codec) marshalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 1, len(data)+1)
+	ret[0] = byte(TypeJSON)
+	return append(ret, data...), nil
+}
+
+// unmarshalJSON decode into the typed pointer v, objects are decoded into
+// map[string]any when v is *any
+func (*Codec) unmarshalJSON(r io.Reader, v any) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -2,22 +2,44 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 
 	"github.com/lwch/crpc/internal/join"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// TypeNamedProtobuf数据格式如下，Name为消息的完整名称，接收方据此查找消息类型
+// +---------+------+------+
+// | Size(2) | Name | Data |
+// +---------+------+------+
+
 func (c *Codec) marshalProtoMessage(v any) ([]byte, error) {
 	var hdr header
 	payload := c.bufPool.Get().(*join.BytesBuffer)
 	defer c.bufPool.Put(payload)
 	payload.Reset()
-	hdr.Type = TypeProtobuf
-	enc, err := proto.Marshal(v.(proto.Message))
+	msg := v.(proto.Message)
+	enc, err := proto.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
+	hdr.Type = TypeProtobuf
+	if !c.cfg.LegacyProtobuf {
+		hdr.Type = TypeNamedProtobuf
+		name := msg.ProtoReflect().Descriptor().FullName()
+		if len(name) > math.MaxUint16 {
+			return nil, errMessageName
+		}
+		err = binary.Write(payload, binary.BigEndian, uint16(len(name)))
+		if err != nil {
+			return nil, err
+		}
+		enc = append([]byte(name), enc...)
+	}
 	_, err = io.Copy(payload, bytes.NewReader(enc))
 	if err != nil {
 		return nil, err
@@ -29,6 +51,7 @@ func (c *Codec) marshalProtoMessage(v any) ([]byte, error) {
 	return joiner.Marshal()
 }
 
+// unmarshalProtoMessage decode TypeProtobuf without the message name
 func (c *Codec) unmarshalProtoMessage(r io.Reader, v any) (int, error) {
 	msg, ok := v.(proto.Message)
 	if !ok {
@@ -43,3 +66,45 @@ func (c *Codec) unmarshalProtoMessage(r io.Reader, v any) (int, error) {
 	}
 	return 0, nil
 }
+
+// unmarshalNamedProtoMessage decode into the proto.Message v of the same
+// type, or into *any with a new message of the type found by the resolver
+func (c *Codec) unmarshalNamedProtoMessage(r io.Reader, v any) (int, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, err
+	}
+	name := make([]byte, size)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return 0, err
+	}
+	fullName := protoreflect.FullName(name)
+	if !fullName.IsValid() {
+		return 0, errMessageName
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	msg, ok := v.(proto.Message)
+	if ok {
+		if got := msg.ProtoReflect().Descriptor().FullName(); got != fullName {
+			return 0, fmt.Errorf("codec: can not decode %s into %s", fullName, got)
+		}
+		return 0, proto.Unmarshal(data, msg)
+	}
+	target, ok := v.(*any)
+	if !ok {
+		return 0, errProtoMessage
+	}
+	mt, err := c.cfg.Resolver.FindMessageByName(fullName)
+	if err != nil {
+		return 0, fmt.Errorf("codec: find message %s: %v", fullName, err)
+	}
+	msg = mt.New().Interface()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return 0, err
+	}
+	*target = msg
+	return 0, nil
+}
@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var errInvalidType = errors.New("codec: invalid type")
+
+// TypeUser the first data type id for applications, the ones below are
+// reserved by crpc
+const TypeUser DataType = 128
+
+// Type marshal and unmarshal funcs of a data type registered by the
+// application, e.g. Cap'n Proto messages or custom binary structs
+type Type struct {
+	// Match reports whether Marshal encodes v with the type
+	Match func(v any) bool
+	// Marshal encode v, the data type id is added by the codec
+	Marshal func(v any) ([]byte, error)
+	// Unmarshal decode data into v, v is a pointer given to
+	// Codec.Unmarshal
+	Unmarshal func(data []byte, v any) error
+}
+
+var registry struct {
+	sync.RWMutex
+	ids   []DataType
+	types map[DataType]Type
+}
+
+// Register register the data type with id for every codec, the types
+// supported by crpc are matched first, the registered ones are matched in
+// the order they are registered
+func Register(id DataType, t Type) error {
+	if id < TypeUser {
+		return fmt.Errorf("codec: data type %d is reserved", id)
+	}
+	if t.Match == nil || t.Marshal == nil || t.Unmarshal == nil {
+		return errInvalidType
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.types == nil {
+		registry.types = make(map[DataType]Type)
+	}
+	if _, ok := registry.types[id]; ok {
+		return fmt.Errorf("codec: data type %d is already registered", id)
+	}
+	registry.ids = append(registry.ids, id)
+	registry.types[id] = t
+	return nil
+}
+
+// unregister remove the data type with id, it is used by tests
+func unregister(id DataType) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.ids = slices.DeleteFunc(registry.ids, func(v DataType) bool {
+		return v == id
+	})
+	delete(registry.types, id)
+}
+
+// lookup returns the registered data type of v
+func lookup(v any) (DataType, Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, id := range registry.ids {
+		if t := registry.types[id]; t.Match(v) {
+			return id, t, true
+		}
+	}
+	return TypeUnknown, Type{}, false
+}
+
+// registered returns the registered data type with id
+func registered(id DataType) (Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.types[id]
+	return t, ok
+}
+
+func (*Codec) marshalRegistered(id DataType, t Type, v any) ([]byte, error) {
+	data, err := t.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 1, len(data)+1)
+	ret[0] = byte(id)
+	return append(ret, data...), nil
+}
+
+func (*Codec) unmarshalRegistered(t Type, data []byte, v any) (int, error) {
+	if err := t.Unmarshal(data, v); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,261 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/lwch/crpc/encoding"
+)
+
+var errFrameTooLarge = errors.New("codec: frame too large")
+
+// DefaultMaxFrameSize default max size of a message read by Decoder
+const DefaultMaxFrameSize = 64 << 20
+
+// frameSize size of the frames the http messages are split into
+const frameSize = 32 << 10
+
+// 数据流中每条消息格式如下：
+// +---------+---------+---------+
+// | Size(4) | Type(1) | Payload |
+// +---------+---------+---------+
+// http消息的Size为1，不包含Payload，其后为http/1.1格式的消息内容，被拆分为
+// 若干Size(4) | Data的数据块，以Size为0的数据块结束，因此body可以流式传输
+
+// Encoder writes length-delimited messages to a stream, it is not safe for
+// concurrent use
+type Encoder struct {
+	w     io.Writer
+	codec encoding.Codec
+}
+
+// NewEncoder create encoder writing to w, e.g. a crpc.Stream or a file
+func NewEncoder(w io.Writer) *Encoder {
+	return NewEncoderWithConfig(w, Config{})
+}
+
+// NewEncoderWithConfig create encoder with the config of its codec, e.g.
+// Config.LegacyProtobuf
+func NewEncoderWithConfig(w io.Writer, cfg Config) *Encoder {
+	return &Encoder{w: w, codec: NewWithConfig(cfg)}
+}
+
+// Encode write v, the bodies of http messages are copied to the stream
+// without being read into memory as a whole and closed afterwards
+func (enc *Encoder) Encode(v any) error {
+	switch value := v.(type) {
+	case http.Request:
+		return enc.encodeHTTP(TypeHTTPRequest, &value)
+	case *http.Request:
+		return enc.encodeHTTP(TypeHTTPRequest, value)
+	case http.Response:
+		return enc.encodeHTTP(TypeHTTPResponse, &value)
+	case *http.Response:
+		return enc.encodeHTTP(TypeHTTPResponse, value)
+	}
+	data, err := enc.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return enc.writeFrame(data)
+}
+
+func (enc *Encoder) writeFrame(data []byte) error {
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err := enc.w.Write(append(frame, data...))
+	return err
+}
+
+func (enc *Encoder) encodeHTTP(t DataType, v interface{ Write(io.Writer) error }) error {
+	if err := enc.writeFrame([]byte{byte(t)}); err != nil {
+		return err
+	}
+	if resp, ok := v.(*http.Response); ok && resp.ProtoMajor == 0 {
+		cp := *resp
+		cp.ProtoMajor, cp.ProtoMinor = 1, 1
+		v = &cp
+	}
+	w := bufio.NewWriterSize(frameWriter{enc}, frameSize)
+	if err := v.Write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return enc.writeFrame(nil)
+}
+
+// frameWriter writes every call as a frame
+type frameWriter struct {
+	enc *Encoder
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.enc.writeFrame(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Decoder reads the messages written by Encoder, it is not safe for
+// concurrent use
+type Decoder struct {
+	r     io.Reader
+	codec *Codec
+	// body of the last http message
+	body *frameReader
+}
+
+// NewDecoder create decoder reading from r, e.g. a crpc.Stream or a file
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderWithConfig(r, Config{})
+}
+
+// NewDecoderWithConfig create decoder with the config of its codec, e.g.
+// Config.Resolver, Config.MaxFrameSize limits every message and the http
+// headers are limited by Config.MaxHeaderBytes and MaxHeaderCount
+func NewDecoderWithConfig(r io.Reader, cfg Config) *Decoder {
+	return &Decoder{r: r, codec: NewWithConfig(cfg).(*Codec)}
+}
+
+// Decode read the next message into the pointer v, the body of a decoded
+// http message is read from the stream on demand and the remaining of it
+// is skipped by the next Decode
+func (dec *Decoder) Decode(v any) error {
+	if dec.body != nil {
+		if _, err := io.Copy(io.Discard, dec.body); err != nil {
+			return err
+		}
+		dec.body = nil
+	}
+	data, err := dec.readFrame()
+	if err != nil {
+		return err
+	}
+	if len(data) == 1 {
+		switch DataType(data[0]) {
+		case TypeHTTPRequest, TypeHTTPResponse:
+			return dec.decodeHTTP(DataType(data[0]), v)
+		}
+	}
+	_, err = dec.codec.Unmarshal(data, v)
+	return err
+}
+
+func (dec *Decoder) readFrame() ([]byte, error) {
+	var size uint32
+	if err := binary.Read(dec.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(dec.codec.cfg.MaxFrameSize) {
+		return nil, errFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(dec.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (dec *Decoder) decodeHTTP(t DataType, v any) error {
+	dec.body = &frameReader{dec: dec}
+	// limit the header like http.Server, the body is not limited
+	cfg := dec.codec.cfg
+	limit := int64(cfg.MaxHeaderBytes) + 4096
+	lr := &io.LimitedReader{R: dec.body, N: limit}
+	r := bufio.NewReader(lr)
+	var msg any
+	var hdr http.Header
+	var err error
+	if t == TypeHTTPRequest {
+		var req *http.Request
+		req, err = http.ReadRequest(r)
+		if err == nil {
+			msg, hdr = req, req.Header
+		}
+	} else {
+		var resp *http.Response
+		resp, err = http.ReadResponse(r, nil)
+		if err == nil {
+			msg, hdr = resp, resp.Header
+		}
+	}
+	// the bytes read ahead by r are not a part of the header
+	size := limit - lr.N - int64(r.Buffered())
+	exceeded := lr.N <= 0
+	lr.N = math.MaxInt64
+	if err != nil {
+		if exceeded {
+			return ErrHeaderTooLarge
+		}
+		return err
+	}
+	if size > int64(cfg.MaxHeaderBytes) {
+		return ErrHeaderTooLarge
+	}
+	lines := 0
+	for _, values := range hdr {
+		lines += len(values)
+	}
+	if lines > cfg.MaxHeaderCount {
+		return ErrTooManyHeaders
+	}
+	switch value := v.(type) {
+	case *http.Request:
+		req, ok := msg.(*http.Request)
+		if !ok {
+			return fmt.Errorf("codec: can not decode %T into %T", msg, v)
+		}
+		*value = *req
+	case *http.Response:
+		resp, ok := msg.(*http.Response)
+		if !ok {
+			return fmt.Errorf("codec: can not decode %T into %T", msg, v)
+		}
+		*value = *resp
+	case *any:
+		*value = msg
+	default:
+		return errUnsupportedType
+	}
+	return nil
+}
+
+// frameReader reads the frames of a http message until the empty frame
+type frameReader struct {
+	dec  *Decoder
+	buf  []byte
+	done bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		data, err := r.dec.readFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.buf = data
+		r.done = len(data) == 0
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lwch/crpc/test_data/pb"
+)
+
+func TestEncoder(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "messages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	body := strings.Repeat("crpc", 100000)
+	// the length of the body is unknown
+	pr, pw := io.Pipe()
+	go func() {
+		io.Copy(pw, strings.NewReader(body))
+		pw.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/upload", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncoder(f)
+	for _, v := range []any{[]byte("raw"), req, &pb.Request{Id: 1}, map[string]int{"n": 1}} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(f)
+	var raw []byte
+	if err := dec.Decode(&raw); err != nil || string(raw) != "raw" {
+		t.Fatalf("decode raw: %q, %v", raw, err)
+	}
+	var newReq http.Request
+	if err := dec.Decode(&newReq); err != nil {
+		t.Fatal(err)
+	}
+	if newReq.URL.Path != "/upload" {
+		t.Fatalf("unexpected path: %s", newReq.URL.Path)
+	}
+	data, err := io.ReadAll(newReq.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte(body)) {
+		t.Fatalf("unexpected body size: %d", len(data))
+	}
+	var msg any
+	if err := dec.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := msg.(*pb.Request); !ok || m.Id != 1 {
+		t.Fatalf("unexpected message: %v", msg)
+	}
+	var m map[string]int
+	if err := dec.Decode(&m); err != nil || m["n"] != 1 {
+		t.Fatalf("decode json: %v, %v", m, err)
+	}
+	if err := dec.Decode(&msg); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDecoderSkipBody(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	rep := &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: -1,
+		Body:          io.NopCloser(strings.NewReader(strings.Repeat("x", 100000))),
+	}
+	if err := enc.Encode(rep); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder(&buf)
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(*http.Response); !ok {
+		t.Fatalf("unexpected type: %T", v)
+	}
+	var raw []byte
+	if err := dec.Decode(&raw); err != nil || string(raw) != "next" {
+		t.Fatalf("decode raw: %q, %v", raw, err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDecoderWithConfig(&buf, Config{MaxFrameSize: 512}).Decode(new([]byte)); err != errFrameTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/upload",
+		strings.NewReader(strings.Repeat("x", 100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		req.Header.Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("v", 100))
+	}
+	buf.Reset()
+	if err := enc.Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var newReq http.Request
+	if err := NewDecoderWithConfig(bytes.NewReader(data), Config{MaxHeaderCount: 5}).Decode(&newReq); err != ErrTooManyHeaders {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewDecoderWithConfig(bytes.NewReader(data), Config{MaxHeaderBytes: 512}).Decode(&newReq); err != ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the body is not limited by the header limits
+	if err := NewDecoderWithConfig(bytes.NewReader(data), Config{MaxHeaderBytes: 2048}).Decode(&newReq); err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(newReq.Body)
+	if err != nil || len(body) != 100000 {
+		t.Fatalf("unexpected body: %d, %v", len(body), err)
+	}
+}
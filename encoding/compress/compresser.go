@@ -15,6 +15,9 @@ import (
 var errNoDecompresser = errors.New("compress: no decompresser")
 var errInvalidChecksum = errors.New("compress: invalid checksum")
 
+// ErrTooLarge decompressed data exceeds the limit
+var ErrTooLarge = errors.New("compress: decompressed data too large")
+
 // Method compress method
 type Method byte
 
@@ -123,6 +126,13 @@ func (cp *Compresser) Compress(data []byte) ([]byte, error) {
 
 // Decompress decompress func
 func (cp *Compresser) Decompress(data []byte) ([]byte, error) {
+	return cp.DecompressLimit(data, 0)
+}
+
+// DecompressLimit decompress func, ErrTooLarge is returned with the first
+// limit bytes when the decompressed data is larger than limit, zero means
+// no limit
+func (cp *Compresser) DecompressLimit(data []byte, limit int) ([]byte, error) {
 	obj := cp.poolDecompresser.Get()
 	if obj == nil {
 		if cp.nd == nil {
@@ -140,10 +150,21 @@ func (cp *Compresser) Decompress(data []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	data, err = io.ReadAll(r)
+	var src io.Reader = r
+	if limit > 0 {
+		// crc32 and one more byte to detect the overflow
+		src = io.LimitReader(r, int64(limit)+5)
+	}
+	data, err = io.ReadAll(src)
 	if err != nil {
 		return nil, err
 	}
+	if limit > 0 && len(data) > limit+4 {
+		return data[:limit], ErrTooLarge
+	}
+	if len(data) < 4 {
+		return nil, errInvalidChecksum
+	}
 	sum := binary.BigEndian.Uint32(data[len(data)-4:])
 	data = data[:len(data)-4]
 	if crc32.ChecksumIEEE(data) != sum {
@@ -12,8 +12,22 @@ type Encrypter interface {
 	Decrypt([]byte) ([]byte, error)
 }
 
+// Cloner is implemented by encrypters with per connection state, e.g.
+// sequence numbers and replay windows, the transport clones the encrypter
+// for every connection
+type Cloner interface {
+	Clone() Encrypter
+}
+
 // Compresser compresser
 type Compresser interface {
 	Compress([]byte) ([]byte, error)
 	Decompress([]byte) ([]byte, error)
 }
+
+// LimitedDecompresser is implemented by compressers able to stop
+// decompressing once the output exceeds the limit, other compressers are
+// checked after the whole data is decompressed
+type LimitedDecompresser interface {
+	DecompressLimit(data []byte, limit int) ([]byte, error)
+}
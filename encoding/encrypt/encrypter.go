@@ -7,7 +7,11 @@ import (
 	"crypto/des"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/lwch/crpc/encoding"
 )
 
 var errInvalidChecksum = errors.New("encrypt: invalid checksum")
@@ -17,20 +21,75 @@ var errInvalidBlockSize = errors.New("encrypt: invalid block size")
 type Method byte
 
 const (
-	// Aes aes method
+	// Aes aes-cbc with a fixed iv and crc32, unauthenticated, NewLegacy only
 	Aes Method = iota
-	// Des des method
+	// Des 3des-cbc with a fixed iv and crc32, unauthenticated, NewLegacy
+	// only
 	Des
+	// AesGCM aes-256-gcm authenticated encryption with a random nonce per
+	// message and replay protection within a connection, see Clone
+	AesGCM
+	// HmacSHA256 integrity only, data is sent in plain text with a
+	// hmac-sha256 tag and replay protection within a connection
+	HmacSHA256
 )
 
+func (m Method) String() string {
+	switch m {
+	case Aes:
+		return "aes-cbc"
+	case Des:
+		return "3des-cbc"
+	case AesGCM:
+		return "aes-256-gcm"
+	case HmacSHA256:
+		return "hmac-sha256"
+	default:
+		return "unknown"
+	}
+}
+
+// Role side of the connection, the two directions of a connection use
+// different subkeys
+type Role byte
+
+const (
+	// RoleClient client side
+	RoleClient Role = iota
+	// RoleServer server side
+	RoleServer
+)
+
+// peer returns the role of the other side
+func (r Role) peer() Role {
+	if r == RoleServer {
+		return RoleClient
+	}
+	return RoleServer
+}
+
 type padFunc func([]byte) []byte
 
-// Encrypter encrypter
-type Encrypter struct {
+// direction cipher state of one direction
+type direction struct {
 	block cipher.Block
 	iv    []byte
+	aead  cipher.AEAD
+	mac   []byte
+}
+
+// Encrypter encrypter
+type Encrypter struct {
+	send  direction
+	recv  direction
 	pad   padFunc
 	unpad padFunc
+	// aead and hmac mode, the role is authenticated with the sequence so
+	// that a message reflected to its sender is rejected even when both
+	// directions share a key
+	role     Role
+	sequence atomic.Uint64
+	window   *window
 }
 
 func makePad(size int) padFunc {
@@ -46,6 +105,9 @@ func makePad(size int) padFunc {
 
 func unpad(p []byte) []byte {
 	padSize := int(p[len(p)-1])
+	if padSize == 0 || padSize > len(p) {
+		return nil
+	}
 	return p[:len(p)-padSize]
 }
 
@@ -56,41 +118,123 @@ func repeat(str string, limit int) string {
 	return str
 }
 
-// New create new encrypter
-func New(m Method, key string) *Encrypter {
-	var block cipher.Block
-	var iv []byte
+// New create new encrypter with subkeys derived from key, the client and
+// the server must use the opposite roles. Only AesGCM and HmacSHA256 are
+// supported, it panics on other methods, the cbc ones are only available
+// by NewLegacy.
+func New(m Method, key *Key, role Role) *Encrypter {
+	c2s := "client->server"
+	s2c := "server->client"
+	sendLabel, recvLabel := c2s, s2c
+	if role == RoleServer {
+		sendLabel, recvLabel = s2c, c2s
+	}
+	send, err := newDirection(m, key, sendLabel)
+	if err != nil {
+		panic(err)
+	}
+	recv, err := newDirection(m, key, recvLabel)
+	if err != nil {
+		panic(err)
+	}
+	return newEncrypter(m, send, recv, role)
+}
+
+func newDirection(m Method, key *Key, label string) (direction, error) {
+	prefix := "crpc " + m.String() + " " + label
+	switch m {
+	case AesGCM:
+		block, err := aes.NewCipher(key.Derive(prefix+" key", 32))
+		if err != nil {
+			return direction{}, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return direction{}, err
+		}
+		return direction{aead: aead}, nil
+	case HmacSHA256:
+		return direction{mac: key.Derive(prefix+" key", 32)}, nil
+	default:
+		return direction{}, fmt.Errorf("encrypt: unsupported method %s, use AesGCM or HmacSHA256", m)
+	}
+}
+
+func newEncrypter(m Method, send, recv direction, role Role) *Encrypter {
+	enc := &Encrypter{
+		send:  send,
+		recv:  recv,
+		unpad: unpad,
+		role:  role,
+	}
+	switch m {
+	case Aes:
+		enc.pad = makePad(aes.BlockSize)
+	case Des:
+		enc.pad = makePad(des.BlockSize)
+	case AesGCM, HmacSHA256:
+		enc.window = new(window)
+	}
+	return enc
+}
+
+// NewLegacy create encrypter compatible with old versions, the key is
+// repeated to the required length and used as both the key and the iv in
+// both directions. Only Aes and Des are supported, it panics on other
+// methods. The messages are neither authenticated nor randomized, use New
+// instead.
+func NewLegacy(m Method, key string) *Encrypter {
+	var d direction
 	var err error
-	var pad padFunc
 	switch m {
 	case Aes:
 		key = repeat(key, 32+aes.BlockSize)
-		block, err = aes.NewCipher([]byte(key[:32]))
+		d.block, err = aes.NewCipher([]byte(key[:32]))
 		if err != nil {
-			return nil
+			panic(err)
 		}
-		iv = []byte(key[32 : 32+aes.BlockSize])
-		pad = makePad(aes.BlockSize)
+		d.iv = []byte(key[32 : 32+aes.BlockSize])
 	case Des:
 		key = repeat(key, 24+des.BlockSize)
-		block, err = des.NewTripleDESCipher([]byte(key[:24]))
+		d.block, err = des.NewTripleDESCipher([]byte(key[:24]))
 		if err != nil {
-			return nil
+			panic(err)
 		}
-		iv = []byte(key[24 : 24+des.BlockSize])
-		pad = makePad(des.BlockSize)
+		d.iv = []byte(key[24 : 24+des.BlockSize])
+	default:
+		panic(fmt.Errorf("encrypt: unsupported legacy method %s, use Aes or Des", m))
+	}
+	return newEncrypter(m, d, d, RoleClient)
+}
+
+// Clone returns an encrypter sharing the keys with fresh replay state,
+// it is called for every connection, see encoding.Cloner. The sequence of
+// every connection starts at 1 with the same keys, so the messages
+// recorded on one connection can be replayed on a new one, and the random
+// nonces of all connections count towards the gcm limit of about 2^32
+// messages per key. Use Exchange for per-connection keys when replays
+// across connections matter.
+func (enc *Encrypter) Clone() encoding.Encrypter {
+	if enc == nil || enc.window == nil {
+		return enc
 	}
 	return &Encrypter{
-		block: block,
-		iv:    iv,
-		pad:   pad,
-		unpad: unpad,
+		send:   enc.send,
+		recv:   enc.recv,
+		role:   enc.role,
+		window: new(window),
 	}
 }
 
 // Encrypt encrypt data
 func (enc *Encrypter) Encrypt(src []byte) ([]byte, error) {
-	bm := cipher.NewCBCEncrypter(enc.block, enc.iv)
+	if enc.send.aead != nil {
+		return enc.seal(src)
+	}
+	if enc.send.mac != nil {
+		return enc.sign(src), nil
+	}
+	bm := cipher.NewCBCEncrypter(enc.send.block, enc.send.iv)
 	src = binary.BigEndian.AppendUint32(src, crc32.ChecksumIEEE(src))
 	src = enc.pad(src)
 	dst := make([]byte, len(src))
@@ -100,16 +244,25 @@ func (enc *Encrypter) Encrypt(src []byte) ([]byte, error) {
 
 // Decrypt decrypt data
 func (enc *Encrypter) Decrypt(src []byte) ([]byte, error) {
+	if enc.recv.aead != nil {
+		return enc.open(src)
+	}
+	if enc.recv.mac != nil {
+		return enc.verify(src)
+	}
 	if len(src) == 0 {
 		return src, nil
 	}
-	bm := cipher.NewCBCDecrypter(enc.block, enc.iv)
+	bm := cipher.NewCBCDecrypter(enc.recv.block, enc.recv.iv)
 	if len(src)%bm.BlockSize() != 0 {
 		return nil, errInvalidBlockSize
 	}
 	dst := make([]byte, len(src))
 	bm.CryptBlocks(dst, src)
 	dst = enc.unpad(dst)
+	if len(dst) < 4 {
+		return nil, errInvalidChecksum
+	}
 	sum := binary.BigEndian.Uint32(dst[len(dst)-4:])
 	dst = dst[:len(dst)-4]
 	if crc32.ChecksumIEEE(dst) != sum {
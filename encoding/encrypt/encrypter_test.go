@@ -0,0 +1,324 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/lwch/crpc/encoding"
+)
+
+var testKey = KeyFromPassphrase("crpc encrypt key", []byte("crpc salt"), 1000)
+
+func TestAesGCM(t *testing.T) {
+	sender := New(AesGCM, testKey, RoleClient).Clone()
+	receiver := New(AesGCM, testKey, RoleServer).Clone()
+	first, err := sender.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sender.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Fatal("same ciphertext for same plaintext")
+	}
+	// out of order delivery is allowed
+	for _, msg := range [][]byte{second, first} {
+		data, err := receiver.Decrypt(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "ping" {
+			t.Fatal("invalid data")
+		}
+	}
+	if _, err := receiver.Decrypt(first); err == nil {
+		t.Fatal("replayed message accepted")
+	}
+	tampered, err := sender.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[len(tampered)-1] ^= 1
+	if _, err := receiver.Decrypt(tampered); err == nil {
+		t.Fatal("tampered message accepted")
+	}
+}
+
+func TestDirection(t *testing.T) {
+	for _, m := range []Method{AesGCM, HmacSHA256} {
+		cli := New(m, testKey, RoleClient).Clone()
+		svr := New(m, testKey, RoleServer).Clone()
+		enc, err := cli.Encrypt([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := svr.Decrypt(enc)
+		if err != nil {
+			t.Fatal(m, err)
+		}
+		if string(data) != "ping" {
+			t.Fatal(m, "invalid data")
+		}
+		// reflected back to the sender
+		if data, err := cli.Decrypt(enc); err == nil && string(data) == "ping" {
+			t.Fatal(m, "reflected message accepted")
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	for _, m := range []Method{Aes, Des} {
+		enc, err := NewLegacy(m, "legacy key").Encrypt([]byte("ping"))
+		if err != nil {
+			t.Fatal(m, err)
+		}
+		data, err := NewLegacy(m, "legacy key").Decrypt(enc)
+		if err != nil {
+			t.Fatal(m, err)
+		}
+		if string(data) != "ping" {
+			t.Fatal(m, "invalid data")
+		}
+	}
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	mustPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: no panic", name)
+			}
+		}()
+		fn()
+	}
+	// cbc is only available for compatibility
+	mustPanic("aes", func() { New(Aes, testKey, RoleClient) })
+	mustPanic("des", func() { New(Des, testKey, RoleClient) })
+	mustPanic("unknown", func() { New(Method(255), testKey, RoleClient) })
+	mustPanic("legacy gcm", func() { NewLegacy(AesGCM, "key") })
+}
+
+func TestReflectSharedKey(t *testing.T) {
+	for _, m := range []Method{AesGCM, HmacSHA256} {
+		// one key for both directions
+		d, err := newDirection(m, testKey, "shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := newEncrypter(m, d, d, RoleClient)
+		svr := newEncrypter(m, d, d, RoleServer)
+		enc, err := cli.Encrypt([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svr.Decrypt(enc); err != nil {
+			t.Fatal(m, err)
+		}
+		if _, err := cli.Decrypt(enc); err == nil {
+			t.Fatal(m, "reflected message accepted")
+		}
+	}
+}
+
+func TestKDF(t *testing.T) {
+	// RFC 5869 test case 1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := KeyFromSecret(ikm, salt).Derive(string(info), 42)
+	if hex.EncodeToString(okm) != "3cb25f25faacd57a90434f64d0362f2a"+
+		"2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Fatal("invalid hkdf output")
+	}
+	// RFC 7914 section 11
+	dk := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	if hex.EncodeToString(dk[:16]) != "55ac046e56e3089fec1691c22544b605" {
+		t.Fatal("invalid pbkdf2 output")
+	}
+}
+
+func exchange(t *testing.T, cli, svr *Exchange) (*Encrypter, *Encrypter, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	type result struct {
+		enc *Encrypter
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		enc, err := svr.Handshake(s, RoleServer)
+		s.Close()
+		ch <- result{enc, err}
+	}()
+	cliEnc, err := cli.Handshake(c, RoleClient)
+	c.Close()
+	ret := <-ch
+	if err == nil {
+		err = ret.err
+	}
+	return cliEnc, ret.enc, err
+}
+
+func TestExchange(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, svr, err := exchange(t,
+		&Exchange{PSK: testKey, ServerPublicKey: priv.PublicKey()},
+		&Exchange{PSK: testKey, PrivateKey: priv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := cli.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := svr.Decrypt(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Fatal("invalid data")
+	}
+	other := KeyFromPassphrase("other key", []byte("crpc salt"), 1000)
+	if _, _, err := exchange(t, &Exchange{PSK: other}, &Exchange{PSK: testKey}); err == nil {
+		t.Fatal("exchange with wrong psk succeeded")
+	}
+	fake, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := exchange(t,
+		&Exchange{ServerPublicKey: priv.PublicKey()},
+		&Exchange{PrivateKey: fake}); err == nil {
+		t.Fatal("exchange with wrong server key succeeded")
+	}
+	// unauthenticated exchanges are refused
+	for name, ex := range map[string]*Exchange{
+		"server with public key": {ServerPublicKey: priv.PublicKey()},
+		"server without key":     {},
+	} {
+		if _, err := ex.Handshake(new(bytes.Buffer), RoleServer); err != errServerExchangeAuth {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for name, ex := range map[string]*Exchange{
+		"client with private key": {PrivateKey: priv},
+		"client without key":      {},
+	} {
+		if _, err := ex.Handshake(new(bytes.Buffer), RoleClient); err != errClientExchangeAuth {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	next := KeyFromPassphrase("next key", []byte("crpc salt"), 1000)
+	cliRing := NewKeyRing()
+	cliRing.Add(1, New(AesGCM, testKey, RoleClient))
+	svrRing := NewKeyRing()
+	svrRing.Add(1, New(AesGCM, testKey, RoleServer))
+	svrRing.Add(2, New(AesGCM, next, RoleServer))
+	cli := cliRing.Clone()
+	svr := svrRing.Clone()
+	roundtrip := func(from, to encoding.Encrypter) error {
+		enc, err := from.Encrypt([]byte("ping"))
+		if err != nil {
+			return err
+		}
+		_, err = to.Decrypt(enc)
+		return err
+	}
+	if err := roundtrip(cli, svr); err != nil {
+		t.Fatal(err)
+	}
+	// client rolls to the new key
+	cliRing.Add(2, New(AesGCM, next, RoleClient))
+	if err := cliRing.SetPrimary(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundtrip(cli, svr); err != nil {
+		t.Fatal(err)
+	}
+	if err := svrRing.SetPrimary(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundtrip(svr, cli); err != nil {
+		t.Fatal(err)
+	}
+	// old key retired
+	old, err := New(AesGCM, testKey, RoleClient).Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svrRing.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svr.Decrypt(append([]byte{0, 0, 0, 1}, old...)); err == nil {
+		t.Fatal("removed key accepted")
+	}
+}
+
+func TestHmac(t *testing.T) {
+	sender := New(HmacSHA256, testKey, RoleClient).Clone()
+	receiver := New(HmacSHA256, testKey, RoleServer).Clone()
+	msg, err := sender.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, []byte("ping")) {
+		t.Fatal("data is not in plain text")
+	}
+	data, err := receiver.Decrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Fatal("invalid data")
+	}
+	if _, err := receiver.Decrypt(msg); err == nil {
+		t.Fatal("replayed message accepted")
+	}
+	tampered, err := sender.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[8] ^= 1
+	if _, err := receiver.Decrypt(tampered); err == nil {
+		t.Fatal("tampered message accepted")
+	}
+}
+
+func TestKeyRingFollowPeer(t *testing.T) {
+	tenant := KeyFromPassphrase("tenant key", []byte("crpc salt"), 1000)
+	svrRing := NewKeyRing()
+	svrRing.Add(1, New(AesGCM, testKey, RoleServer))
+	svrRing.Add(2, New(AesGCM, tenant, RoleServer))
+	svrRing.SetFollowPeer(true)
+	cliRing := NewKeyRing()
+	cliRing.Add(2, New(AesGCM, tenant, RoleClient))
+	svr := svrRing.Clone()
+	cli := cliRing.Clone()
+	msg, err := cli.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svr.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = svr.Encrypt([]byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+}
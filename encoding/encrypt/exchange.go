@@ -0,0 +1,147 @@
+package encrypt
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+var errKeyExchange = errors.New("encrypt: key exchange failed")
+var errServerExchangeAuth = errors.New("encrypt: server key exchange requires a psk or a private key")
+var errClientExchangeAuth = errors.New("encrypt: client key exchange requires a psk or a server public key")
+var errKeyExchangeVersion = errors.New("encrypt: unsupported key exchange version")
+
+const keyExchangeVersion = 1
+
+// Exchange ephemeral x25519 key exchange, every connection derives its own
+// aes-256-gcm session keys, so a leaked long-lived key does not decrypt
+// recorded traffic and the messages of one connection can not be replayed
+// on another. The exchange is authenticated by PSK, by the server
+// key pinned on the client or by both, they must be configured the same
+// way on both sides.
+type Exchange struct {
+	// PSK pre-shared key, authenticates both sides
+	PSK *Key
+	// PrivateKey static x25519 key of the server, server side only
+	PrivateKey *ecdh.PrivateKey
+	// ServerPublicKey pinned server public key, client side only
+	ServerPublicKey *ecdh.PublicKey
+}
+
+// 握手流程，客户端首先发送ClientHello
+//
+//	client -> server: Version(1) | Ephemeral(32)
+//	server -> client: Ephemeral(32) | ServerFinished(32)
+//	client -> server: ClientFinished(32)
+//
+// 会话密钥由两端临时公钥的ECDH结果、服务端静态公钥参与的ECDH结果(可选)
+// 以及PSK(可选)通过HKDF派生而来
+
+// Handshake run the key exchange on rw and returns the session encrypter,
+// the client must use RoleClient and the server RoleServer
+func (ex *Exchange) Handshake(rw io.ReadWriter, role Role) (*Encrypter, error) {
+	// the keys of the other side do not authenticate the exchange
+	if role == RoleServer && ex.PSK == nil && ex.PrivateKey == nil {
+		return nil, errServerExchangeAuth
+	}
+	if role != RoleServer && ex.PSK == nil && ex.ServerPublicKey == nil {
+		return nil, errClientExchangeAuth
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if role == RoleServer {
+		return ex.serverHandshake(rw, eph)
+	}
+	return ex.clientHandshake(rw, eph)
+}
+
+func (ex *Exchange) clientHandshake(rw io.ReadWriter, eph *ecdh.PrivateKey) (*Encrypter, error) {
+	hello := append([]byte{keyExchangeVersion}, eph.PublicKey().Bytes()...)
+	if _, err := rw.Write(hello); err != nil {
+		return nil, err
+	}
+	var reply [64]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(reply[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var static []byte
+	if ex.ServerPublicKey != nil {
+		static, err = eph.ECDH(ex.ServerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := ex.sessionKey(eph.PublicKey(), peer, shared, static)
+	if !hmac.Equal(reply[32:], key.Derive("crpc key exchange server finished", 32)) {
+		return nil, errKeyExchange
+	}
+	if _, err := rw.Write(key.Derive("crpc key exchange client finished", 32)); err != nil {
+		return nil, err
+	}
+	return New(AesGCM, key, RoleClient), nil
+}
+
+func (ex *Exchange) serverHandshake(rw io.ReadWriter, eph *ecdh.PrivateKey) (*Encrypter, error) {
+	var hello [33]byte
+	if _, err := io.ReadFull(rw, hello[:]); err != nil {
+		return nil, err
+	}
+	if hello[0] != keyExchangeVersion {
+		return nil, errKeyExchangeVersion
+	}
+	peer, err := ecdh.X25519().NewPublicKey(hello[1:])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var static []byte
+	if ex.PrivateKey != nil {
+		static, err = ex.PrivateKey.ECDH(peer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := ex.sessionKey(peer, eph.PublicKey(), shared, static)
+	reply := append(eph.PublicKey().Bytes(), key.Derive("crpc key exchange server finished", 32)...)
+	if _, err := rw.Write(reply); err != nil {
+		return nil, err
+	}
+	var finished [32]byte
+	if _, err := io.ReadFull(rw, finished[:]); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(finished[:], key.Derive("crpc key exchange client finished", 32)) {
+		return nil, errKeyExchange
+	}
+	return New(AesGCM, key, RoleServer), nil
+}
+
+// sessionKey derive the session key, the transcript of both ephemeral
+// public keys is used as the salt
+func (ex *Exchange) sessionKey(client, server *ecdh.PublicKey, shared, static []byte) *Key {
+	h := sha256.New()
+	h.Write([]byte("crpc key exchange v1"))
+	h.Write(client.Bytes())
+	h.Write(server.Bytes())
+	secret := append(shared, static...)
+	if ex.PSK != nil {
+		secret = append(secret, ex.PSK.Derive("crpc key exchange psk", 32)...)
+	}
+	return KeyFromSecret(secret, h.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+var errInvalidSize = errors.New("encrypt: invalid message size")
+
+// gcm消息格式，Sequence和发送方的Role作为附加数据参与认证，Role不发送
+// +-----------+-------------+------------+---------+
+// | Nonce(12) | Sequence(8) | Ciphertext | Tag(16) |
+// +-----------+-------------+------------+---------+
+
+// additional returns the additional data of the message sent by role
+func additional(seq []byte, role Role) []byte {
+	ad := make([]byte, 0, len(seq)+1)
+	ad = append(ad, seq...)
+	return append(ad, byte(role))
+}
+
+func (enc *Encrypter) seal(src []byte) ([]byte, error) {
+	nonceSize := enc.send.aead.NonceSize()
+	dst := make([]byte, nonceSize+8, nonceSize+8+len(src)+enc.send.aead.Overhead())
+	if _, err := rand.Read(dst[:nonceSize]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(dst[nonceSize:], enc.sequence.Add(1))
+	ad := additional(dst[nonceSize:], enc.role)
+	return enc.send.aead.Seal(dst, dst[:nonceSize], src, ad), nil
+}
+
+func (enc *Encrypter) open(src []byte) ([]byte, error) {
+	nonceSize := enc.recv.aead.NonceSize()
+	if len(src) < nonceSize+8+enc.recv.aead.Overhead() {
+		return nil, errInvalidSize
+	}
+	nonce := src[:nonceSize]
+	seq := binary.BigEndian.Uint64(src[nonceSize:])
+	if err := enc.window.check(seq); err != nil {
+		return nil, err
+	}
+	ad := additional(src[nonceSize:nonceSize+8], enc.role.peer())
+	dst, err := enc.recv.aead.Open(nil, nonce, src[nonceSize+8:], ad)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.window.update(seq); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,47 @@
+package encrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+var errInvalidTag = errors.New("encrypt: invalid hmac tag")
+
+// hmac消息格式，Tag覆盖发送方的Role、Sequence和Data，Role不发送，帧头中的
+// 序列号未经认证，因此使用本层独立的序列号防止重放
+// +-------------+------+----------+
+// | Sequence(8) | Data | Tag(32)  |
+// +-------------+------+----------+
+
+func (enc *Encrypter) sign(src []byte) []byte {
+	dst := make([]byte, 8, 8+len(src)+sha256.Size)
+	binary.BigEndian.PutUint64(dst, enc.sequence.Add(1))
+	dst = append(dst, src...)
+	mac := hmac.New(sha256.New, enc.send.mac)
+	mac.Write([]byte{byte(enc.role)})
+	mac.Write(dst)
+	return mac.Sum(dst)
+}
+
+func (enc *Encrypter) verify(src []byte) ([]byte, error) {
+	if len(src) < 8+sha256.Size {
+		return nil, errInvalidSize
+	}
+	body := src[:len(src)-sha256.Size]
+	seq := binary.BigEndian.Uint64(body)
+	if err := enc.window.check(seq); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, enc.recv.mac)
+	mac.Write([]byte{byte(enc.role.peer())})
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), src[len(body):]) {
+		return nil, errInvalidTag
+	}
+	if err := enc.window.update(seq); err != nil {
+		return nil, err
+	}
+	return body[8:], nil
+}
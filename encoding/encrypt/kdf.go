@@ -0,0 +1,85 @@
+package encrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// DefaultIterations default PBKDF2 iterations for passphrases
+const DefaultIterations = 600000
+
+// Key key material, cipher keys are derived from it by HKDF-Expand with a
+// distinct label for every method, direction and purpose
+type Key struct {
+	prk []byte
+}
+
+// KeyFromPassphrase derive key material from a passphrase by
+// PBKDF2-HMAC-SHA256, both sides must use the same salt, iterations less
+// than or equal to zero means DefaultIterations
+func KeyFromPassphrase(passphrase string, salt []byte, iterations int) *Key {
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+	return &Key{prk: pbkdf2([]byte(passphrase), salt, iterations, sha256.Size)}
+}
+
+// KeyFromSecret derive key material from binary secret by
+// HKDF-Extract-SHA256, salt is optional
+func KeyFromSecret(secret, salt []byte) *Key {
+	return &Key{prk: hkdfExtract(salt, secret)}
+}
+
+// Derive derive a subkey of size bytes for the purpose
+func (k *Key) Derive(purpose string, size int) []byte {
+	return hkdfExpand(k.prk, []byte(purpose), size)
+}
+
+// hkdfExtract RFC 5869
+func hkdfExtract(salt, secret []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand RFC 5869
+func hkdfExpand(prk, info []byte, size int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	var out, prev []byte
+	for i := byte(1); len(out) < size; i++ {
+		mac.Reset()
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:size]
+}
+
+// pbkdf2 RFC 8018 with HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	mac := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < size; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:size]
+}
@@ -0,0 +1,179 @@
+package encrypt
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lwch/crpc/encoding"
+)
+
+var errUnknownKey = errors.New("encrypt: unknown key id")
+var errRemovePrimary = errors.New("encrypt: can not remove the primary key")
+
+// keyRingState keys shared by the key ring and all of its clones
+type keyRingState struct {
+	sync.RWMutex
+	keys       map[uint32]encoding.Encrypter
+	primary    uint32
+	followPeer bool
+}
+
+// KeyRing encrypter holding several keys, every message is prefixed with
+// the id of the key it is encrypted with, messages of any key in the ring
+// are accepted and new messages are encrypted with the primary key.
+//
+// Keys are rolled without restarting: add the new key on every side, switch
+// the primary key, then remove the old key once it is no longer used.
+type KeyRing struct {
+	state atomic.Pointer[keyRingState]
+	// per connection clones of the keys
+	mu    sync.Mutex
+	cache map[uint32]cachedKey
+	// peer key id of the last received message plus one
+	peer atomic.Uint64
+}
+
+type cachedKey struct {
+	base  encoding.Encrypter
+	clone encoding.Encrypter
+}
+
+// NewKeyRing create key ring, the first added key becomes the primary key
+func NewKeyRing() *KeyRing {
+	kr := &KeyRing{cache: make(map[uint32]cachedKey)}
+	kr.state.Store(&keyRingState{keys: make(map[uint32]encoding.Encrypter)})
+	return kr
+}
+
+// Add add or replace the key with id
+func (kr *KeyRing) Add(id uint32, enc encoding.Encrypter) {
+	state := kr.state.Load()
+	state.Lock()
+	defer state.Unlock()
+	if len(state.keys) == 0 {
+		state.primary = id
+	}
+	state.keys[id] = enc
+}
+
+// Remove remove the key with id, messages of it are rejected afterwards,
+// the primary key can not be removed
+func (kr *KeyRing) Remove(id uint32) error {
+	state := kr.state.Load()
+	state.Lock()
+	defer state.Unlock()
+	if id == state.primary {
+		return errRemovePrimary
+	}
+	delete(state.keys, id)
+	return nil
+}
+
+// SetPrimary set the key used for encrypting, it takes effect on all
+// connections
+func (kr *KeyRing) SetPrimary(id uint32) error {
+	state := kr.state.Load()
+	state.Lock()
+	defer state.Unlock()
+	if _, ok := state.keys[id]; !ok {
+		return errUnknownKey
+	}
+	state.primary = id
+	return nil
+}
+
+// SetFollowPeer encrypt with the key of the last received message on
+// each connection instead of the primary key, e.g. a server holding the
+// keys of all tenants answers every client with its own key
+func (kr *KeyRing) SetFollowPeer(follow bool) {
+	state := kr.state.Load()
+	state.Lock()
+	defer state.Unlock()
+	state.followPeer = follow
+}
+
+// Primary returns the id of the primary key
+func (kr *KeyRing) Primary() uint32 {
+	state := kr.state.Load()
+	state.RLock()
+	defer state.RUnlock()
+	return state.primary
+}
+
+// Clone returns a key ring sharing the keys with its own per connection
+// state, see encoding.Cloner
+func (kr *KeyRing) Clone() encoding.Encrypter {
+	clone := &KeyRing{cache: make(map[uint32]cachedKey)}
+	clone.state.Store(kr.state.Load())
+	return clone
+}
+
+// Update share the keys of other from now on, e.g. a reloaded config, the
+// per connection state of the keys with the same id and encrypter is kept
+func (kr *KeyRing) Update(other *KeyRing) {
+	kr.state.Store(other.state.Load())
+}
+
+// get returns the per connection encrypter of id
+func (kr *KeyRing) get(id uint32) (encoding.Encrypter, error) {
+	state := kr.state.Load()
+	state.RLock()
+	base, ok := state.keys[id]
+	state.RUnlock()
+	if !ok {
+		return nil, errUnknownKey
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if cached, ok := kr.cache[id]; ok && cached.base == base {
+		return cached.clone, nil
+	}
+	clone := base
+	if cloner, ok := base.(encoding.Cloner); ok {
+		clone = cloner.Clone()
+	}
+	kr.cache[id] = cachedKey{base: base, clone: clone}
+	return clone, nil
+}
+
+// Encrypt encrypt data with the primary key, see SetFollowPeer
+func (kr *KeyRing) Encrypt(src []byte) ([]byte, error) {
+	state := kr.state.Load()
+	state.RLock()
+	id := state.primary
+	if peer := kr.peer.Load(); state.followPeer && peer > 0 {
+		id = uint32(peer - 1)
+	}
+	state.RUnlock()
+	enc, err := kr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := enc.Encrypt(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(dst, id)
+	return append(dst, data...), nil
+}
+
+// Decrypt decrypt data with the key of its id
+func (kr *KeyRing) Decrypt(src []byte) ([]byte, error) {
+	if len(src) < 4 {
+		return nil, errInvalidSize
+	}
+	id := binary.BigEndian.Uint32(src)
+	enc, err := kr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := enc.Decrypt(src[4:])
+	if err != nil {
+		return nil, err
+	}
+	kr.peer.Store(uint64(id) + 1)
+	return data, nil
+}
@@ -0,0 +1,70 @@
+package encrypt
+
+import (
+	"errors"
+	"sync"
+)
+
+var errReplay = errors.New("encrypt: replayed message")
+
+// 重放窗口大小，允许乱序到达的消息数
+const windowSize = 1024
+
+// window sliding window of received sequences, messages may be encrypted
+// and sent by different goroutines so they are not strictly in order
+type window struct {
+	mu     sync.Mutex
+	latest uint64
+	bitmap [windowSize / 64]uint64
+}
+
+func (w *window) bit(seq uint64) (int, uint64) {
+	idx := seq % windowSize
+	return int(idx / 64), 1 << (idx % 64)
+}
+
+// check reports whether seq is seen before or is too old, the sequence
+// must be accepted by update after the message is authenticated
+func (w *window) check(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq == 0 {
+		return errReplay
+	}
+	if seq > w.latest {
+		return nil
+	}
+	if w.latest-seq >= windowSize {
+		return errReplay
+	}
+	i, mask := w.bit(seq)
+	if w.bitmap[i]&mask != 0 {
+		return errReplay
+	}
+	return nil
+}
+
+func (w *window) update(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq > w.latest {
+		diff := seq - w.latest
+		if diff >= windowSize {
+			w.bitmap = [windowSize / 64]uint64{}
+		} else {
+			for s := w.latest + 1; s <= seq; s++ {
+				i, mask := w.bit(s)
+				w.bitmap[i] &^= mask
+			}
+		}
+		w.latest = seq
+	} else if w.latest-seq >= windowSize {
+		return errReplay
+	}
+	i, mask := w.bit(seq)
+	if w.bitmap[i]&mask != 0 {
+		return errReplay
+	}
+	w.bitmap[i] |= mask
+	return nil
+}
@@ -3,5 +3,8 @@ package example
 // Key encrypt key
 const Key = "crpc encrypt key"
 
+// Salt salt for deriving the encrypt key
+const Salt = "crpc example salt"
+
 // Listen listen address
 const Listen = "localhost:8080"
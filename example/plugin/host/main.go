@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lwch/crpc/plugin"
+)
+
+func assert(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: %s <plugin binary>", os.Args[0])
+	}
+	p, err := plugin.Start(plugin.Config{
+		Path: os.Args[1],
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("1.0.0")),
+			}, nil
+		},
+	})
+	assert(err)
+	defer p.Close()
+	for {
+		func() {
+			req, err := http.NewRequest(http.MethodGet, "http://plugin/ping", nil)
+			assert(err)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			rep, err := p.Client().Call(ctx, req)
+			if err != nil {
+				log.Printf("call: %v", err)
+				return
+			}
+			data, err := io.ReadAll(rep.Body)
+			assert(err)
+			log.Printf("status_code=%d, data=%s", rep.StatusCode, string(data))
+		}()
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lwch/crpc/plugin"
+)
+
+func assert(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	host, err := plugin.Serve(plugin.ServeConfig{
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("pong from plugin")),
+			}, nil
+		},
+	})
+	assert(err)
+	defer host.Close()
+	req, err := http.NewRequest(http.MethodGet, "http://host/version", nil)
+	assert(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rep, err := host.Call(ctx, req)
+	assert(err)
+	data, err := io.ReadAll(rep.Body)
+	assert(err)
+	log.Printf("host version: %s", string(data))
+	<-host.Done()
+}
@@ -21,7 +21,9 @@ func main() {
 	cli, err := crpc.NewClient(example.Listen)
 	assert(err)
 	defer cli.Close()
-	cli.SetEncrypter(encrypt.New(encrypt.Aes, example.Key))
+	cli.SetEncrypter(encrypt.New(encrypt.AesGCM,
+		encrypt.KeyFromPassphrase(example.Key, []byte(example.Salt), 0),
+		encrypt.RoleClient))
 	cli.SetCompresser(compress.New(compress.Gzip))
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
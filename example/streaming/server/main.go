@@ -11,7 +11,9 @@ import (
 
 func main() {
 	svr := crpc.NewServer(crpc.ServerConfig{
-		Encrypter:  encrypt.New(encrypt.Aes, example.Key),
+		Encrypter: encrypt.New(encrypt.AesGCM,
+			encrypt.KeyFromPassphrase(example.Key, []byte(example.Salt), 0),
+			encrypt.RoleServer),
 		Compresser: compress.New(compress.Gzip),
 		OnAccept: func(s *crpc.Stream) {
 			defer s.Close()
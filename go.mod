@@ -5,6 +5,7 @@ go 1.23
 require (
 	github.com/klauspost/compress v1.18.3
 	github.com/lwch/logging v1.1.3
+	golang.org/x/sys v0.30.0
 	google.golang.org/protobuf v1.36.11
 )
 
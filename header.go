@@ -1,8 +1,15 @@
 package crpc
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+
+	"github.com/lwch/crpc/encoding"
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/compress"
 )
 
 const keyRequestID = "X-Crpc-Request-Id"
@@ -13,7 +20,7 @@ func (tp *transport) buildRequest(req *http.Request) ([]byte, uint64, error) {
 	}
 	seq := tp.sequence.Add(1)
 	req.Header.Set(keyRequestID, fmt.Sprintf("%d", seq))
-	payload, err := tp.codec.Marshal(req)
+	payload, err := tp.codec().Marshal(req)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -37,7 +44,7 @@ func (tp *transport) buildResponse(rep *http.Response, reqID uint64) ([]byte, er
 		rep.Header = make(http.Header)
 	}
 	rep.Header.Set(keyRequestID, fmt.Sprintf("%d", reqID))
-	payload, err := tp.codec.Marshal(rep)
+	payload, err := tp.codec().Marshal(rep)
 	if err != nil {
 		return nil, err
 	}
@@ -64,17 +71,95 @@ func (tp *transport) decode(data []byte) (any, error) {
 			return nil, err
 		}
 	}
+	data, err := tp.decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	_, err = tp.codec().Unmarshal(data, &value)
+	if errors.Is(err, codec.ErrHeaderTooLarge) || errors.Is(err, codec.ErrTooManyHeaders) {
+		return nil, &droppedError{head: data, err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// droppedError error of the message dropped by the limits with the
+// beginning of the message, it is used to find the request id
+type droppedError struct {
+	head []byte
+	err  error
+}
+
+func (e *droppedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *droppedError) Unwrap() error {
+	return e.err
+}
+
+// decompress decompress data within Limits.MaxMessageSize
+func (tp *transport) decompress(data []byte) ([]byte, error) {
+	limit := tp.limits().MaxMessageSize
 	if tp.compresser != nil {
 		var err error
-		data, err = tp.compresser.Decompress(data)
+		if dec, ok := tp.compresser.(encoding.LimitedDecompresser); ok {
+			data, err = dec.DecompressLimit(data, limit)
+			if errors.Is(err, compress.ErrTooLarge) {
+				return nil, &droppedError{head: data, err: ErrMessageTooLarge}
+			}
+		} else {
+			data, err = tp.compresser.Decompress(data)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
-	var value any
-	_, err := tp.codec.Unmarshal(data, &value)
-	if err != nil {
-		return nil, err
+	if len(data) > limit {
+		return nil, &droppedError{head: data[:limit], err: ErrMessageTooLarge}
 	}
-	return value, nil
+	return data, nil
+}
+
+// limitedBody returns ErrBodyTooLarge when more than n bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// readBody buffer the body in memory, ErrBodyTooLarge is returned when it
+// is larger than Limits.MaxBodySize
+func (tp *transport) readBody(body io.ReadCloser) (io.ReadCloser, int64, error) {
+	if body == nil {
+		return nil, 0, nil
+	}
+	defer body.Close()
+	var r io.Reader = body
+	limit := tp.limits().MaxBodySize
+	if limit > 0 {
+		r = io.LimitReader(body, limit+1)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, 0, err
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		return nil, 0, ErrBodyTooLarge
+	}
+	return io.NopCloser(&buf), int64(buf.Len()), nil
 }
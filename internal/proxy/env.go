@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// FromEnvironment returns the proxy url for addr from HTTPS_PROXY, ALL_PROXY and NO_PROXY
+func FromEnvironment(addr string) (*url.URL, error) {
+	str := getenv("HTTPS_PROXY")
+	if len(str) == 0 {
+		str = getenv("ALL_PROXY")
+	}
+	if len(str) == 0 {
+		return nil, nil
+	}
+	if bypass(addr, getenv("NO_PROXY")) {
+		return nil, nil
+	}
+	return Parse(str)
+}
+
+// Parse parse proxy url, http scheme is used when omitted
+func Parse(str string) (*url.URL, error) {
+	if !strings.Contains(str, "://") {
+		str = "http://" + str
+	}
+	return url.Parse(str)
+}
+
+func getenv(key string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return os.Getenv(strings.ToLower(key))
+}
+
+func bypass(addr, noProxy string) bool {
+	if len(noProxy) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, rule := range strings.Split(noProxy, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if len(rule) == 0 {
+			continue
+		}
+		if rule == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(rule); err == nil {
+			rule = h
+		}
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		rule = strings.TrimPrefix(rule, "*")
+		if host == strings.TrimPrefix(rule, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(rule, ".")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+func dialHTTP(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	port := "80"
+	if proxy.Scheme == "https" {
+		port = "443"
+	}
+	conn, err := dialProxy(ctx, proxy, port)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy: tls handshake: %v", err)
+		}
+		conn = tlsConn
+	}
+	err = handshake(ctx, conn, func() error {
+		return connect(conn, proxy, addr)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func connect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("proxy: write connect request: %v", err)
+	}
+	// read byte by byte through a tiny buffer so that no tunnel data is consumed
+	rep, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), req)
+	if err != nil {
+		return fmt.Errorf("proxy: read connect response: %v", err)
+	}
+	rep.Body.Close()
+	if rep.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy: connect %s: %s", addr, rep.Status)
+	}
+	return nil
+}
+
+type byteReader struct {
+	conn net.Conn
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.conn.Read(p)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+var errUnsupportedScheme = errors.New("proxy: unsupported scheme")
+
+// Dial dial addr through the given proxy
+func Dial(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	switch proxy.Scheme {
+	case "http", "https":
+		return dialHTTP(ctx, proxy, addr)
+	case "socks5", "socks5h":
+		return dialSocks5(ctx, proxy, addr)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, proxy.Scheme)
+	}
+}
+
+func dialProxy(ctx context.Context, proxy *url.URL, defaultPort string) (net.Conn, error) {
+	host := proxy.Host
+	if proxy.Port() == "" {
+		host = net.JoinHostPort(proxy.Hostname(), defaultPort)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: dial %s: %v", host, err)
+	}
+	return conn, nil
+}
+
+// handshake runs fn with the connection deadline bound to ctx, the
+// connection must not be used when it returns an error
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := fn()
+	if !stop() {
+		// ctx is done, the deadline may be set at any time from now on
+		if err == nil {
+			err = ctx.Err()
+		}
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serve accepts one connection, runs handshake on it and echoes the data
+// after it
+func serve(t *testing.T, handshake func(net.Conn) error) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := handshake(conn); err != nil {
+			t.Errorf("handshake: %v", err)
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	return l.Addr().String()
+}
+
+// echo check the tunnel still works after ctx is canceled
+func echo(t *testing.T, proxy *url.URL, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	conn, err := Dial(ctx, proxy, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected data: %s", buf)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	addr := serve(t, func(conn net.Conn) error {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+		if req.Method != http.MethodConnect || req.Host != "backend:8080" ||
+			req.Header.Get("Proxy-Authorization") != auth {
+			_, err := io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return err
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	})
+	echo(t, &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("user", "pass")}, "backend:8080")
+}
+
+func TestHTTPRefused(t *testing.T) {
+	addr := serve(t, func(conn net.Conn) error {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+		return err
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := Dial(ctx, &url.URL{Scheme: "http", Host: addr}, "backend:8080"); err == nil {
+		t.Fatal("refused tunnel connected")
+	}
+}
+
+// socksServer returns the address type and host requested by the client
+func socksServer(conn net.Conn, atyp *byte, host *string) error {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksAuthNone}); err != nil {
+		return err
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	*atyp = req[3]
+	switch req[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return err
+		}
+		*host = net.IP(ip).String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return err
+		}
+		*host = string(name)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return err
+	}
+	rep := []byte{socksVersion, 0, 0, socksAtypIPv4, 127, 0, 0, 1}
+	_, err := conn.Write(binary.BigEndian.AppendUint16(rep, 1080))
+	return err
+}
+
+func TestSocks5(t *testing.T) {
+	for scheme, want := range map[string]byte{
+		"socks5":  socksAtypIPv4,
+		"socks5h": socksAtypDomain,
+	} {
+		t.Run(scheme, func(t *testing.T) {
+			requested := make(chan string, 1)
+			addr := serve(t, func(conn net.Conn) error {
+				var atyp byte
+				var host string
+				err := socksServer(conn, &atyp, &host)
+				if atyp != want {
+					err = fmt.Errorf("unexpected address type %d for %s", atyp, host)
+				}
+				requested <- host
+				return err
+			})
+			echo(t, &url.URL{Scheme: scheme, Host: addr}, "localhost:8080")
+			<-requested
+		})
+	}
+}
+
+func TestBypass(t *testing.T) {
+	for _, c := range []struct {
+		addr    string
+		noProxy string
+		bypass  bool
+	}{
+		{"example.com:80", "", false},
+		{"example.com:80", "*", true},
+		{"example.com:80", "example.com", true},
+		{"api.example.com:80", ".example.com", true},
+		{"api.example.com:80", "*.example.com", true},
+		{"badexample.com:80", "example.com", false},
+		{"10.1.2.3:80", "10.0.0.0/8", true},
+		{"192.168.1.1:80", "10.0.0.0/8", false},
+		{"example.com:80", "other.com, example.com:443", true},
+	} {
+		if got := bypass(c.addr, c.noProxy); got != c.bypass {
+			t.Errorf("bypass(%q, %q) = %v", c.addr, c.noProxy, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+var errSocksVersion = errors.New("proxy: invalid socks version")
+var errSocksAuth = errors.New("proxy: socks authentication failed")
+var errSocksMethod = errors.New("proxy: no acceptable socks authentication method")
+var errSocksAddr = errors.New("proxy: invalid socks address")
+
+const (
+	socksVersion     = 5
+	socksAuthNone    = 0
+	socksAuthPass    = 2
+	socksAuthNoMatch = 0xff
+	socksCmdConnect  = 1
+	socksAtypIPv4    = 1
+	socksAtypDomain  = 3
+	socksAtypIPv6    = 4
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general socks server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"ttl expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func dialSocks5(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme == "socks5" {
+		// socks5 resolves the host locally, socks5h by the proxy
+		var err error
+		addr, err = resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := dialProxy(ctx, proxy, "1080")
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		if err := socksAuth(conn, proxy.User); err != nil {
+			return err
+		}
+		return socksConnect(conn, addr)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resolve replace the host of addr with its ip
+func resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("proxy: resolve %s: %v", host, err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("proxy: resolve %s: no address", host)
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+func socksAuth(conn net.Conn, user *url.Userinfo) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthNone, socksAuthPass}
+	}
+	req := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("proxy: write socks greeting: %v", err)
+	}
+	var rep [2]byte
+	if _, err := io.ReadFull(conn, rep[:]); err != nil {
+		return fmt.Errorf("proxy: read socks greeting: %v", err)
+	}
+	if rep[0] != socksVersion {
+		return errSocksVersion
+	}
+	switch rep[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPass:
+		if user == nil {
+			return errSocksMethod
+		}
+	default:
+		return errSocksMethod
+	}
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errSocksAuth
+	}
+	// RFC1929 username/password authentication
+	req = []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("proxy: write socks auth: %v", err)
+	}
+	if _, err := io.ReadFull(conn, rep[:]); err != nil {
+		return fmt.Errorf("proxy: read socks auth: %v", err)
+	}
+	if rep[1] != 0 {
+		return errSocksAuth
+	}
+	return nil
+}
+
+func socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("proxy: invalid port %s", portStr)
+	}
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			req = append(req, socksAtypIPv4)
+			req = append(req, ip.Unmap().AsSlice()...)
+		} else {
+			req = append(req, socksAtypIPv6)
+			req = append(req, ip.AsSlice()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errSocksAddr
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("proxy: write socks connect: %v", err)
+	}
+	var rep [4]byte
+	if _, err := io.ReadFull(conn, rep[:]); err != nil {
+		return fmt.Errorf("proxy: read socks connect: %v", err)
+	}
+	if rep[0] != socksVersion {
+		return errSocksVersion
+	}
+	if rep[1] != 0 {
+		reason := "unknown error"
+		if int(rep[1]) < len(socksReplies) {
+			reason = socksReplies[rep[1]]
+		}
+		return fmt.Errorf("proxy: socks connect %s: %s", addr, reason)
+	}
+	// skip bound address
+	var size int
+	switch rep[3] {
+	case socksAtypIPv4:
+		size = net.IPv4len
+	case socksAtypIPv6:
+		size = net.IPv6len
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return fmt.Errorf("proxy: read socks bound address: %v", err)
+		}
+		size = int(n[0])
+	default:
+		return errSocksAddr
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(size+2)); err != nil {
+		return fmt.Errorf("proxy: read socks bound address: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package crpc
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/network/proxyproto"
+	"github.com/lwch/logging"
+)
+
+// ErrMessageTooLarge decompressed message is larger than
+// Limits.MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrBodyTooLarge body is larger than Limits.MaxBodySize
+var ErrBodyTooLarge = errors.New("body too large")
+
+// ErrTooManyPendingCalls pending calls reach Limits.MaxPendingCalls
+var ErrTooManyPendingCalls = errors.New("too many pending calls")
+
+// DefaultMaxMessageSize default max size of a decompressed message
+const DefaultMaxMessageSize = 16 << 20
+
+// Limits resource limits of every connection, a message breaching a limit
+// is dropped or answered with an error, the connection keeps working
+type Limits struct {
+	// MaxMessageSize max size of a decompressed message, requests are
+	// answered with 413 and calls return ErrMessageTooLarge, zero means
+	// DefaultMaxMessageSize
+	MaxMessageSize int
+	// MaxHeaderBytes and MaxHeaderCount limit the http headers, see
+	// codec.Config, requests are answered with 431 and calls return
+	// codec.ErrHeaderTooLarge or codec.ErrTooManyHeaders
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	// MaxBodySize max size of request and response bodies, requests are
+	// answered with 413 and calls return ErrBodyTooLarge, zero means no
+	// limit other than MaxMessageSize
+	MaxBodySize int64
+	// MaxPendingCalls max number of calls waiting for responses and max
+	// number of requests being handled, requests are answered with 503
+	// and calls return ErrTooManyPendingCalls, zero means no limit
+	MaxPendingCalls int
+}
+
+// isLimitError reports whether the message is dropped by the limits
+func isLimitError(err error) bool {
+	return errors.Is(err, ErrMessageTooLarge) ||
+		errors.Is(err, codec.ErrHeaderTooLarge) ||
+		errors.Is(err, codec.ErrTooManyHeaders)
+}
+
+var errDenied = errors.New("denied by ip list")
+var errTooManyConns = errors.New("too many connections")
+var errTooManyConnsPerIP = errors.New("too many connections from the ip")
+
+// connLimiter ip lists and connection limits checked in the accept loop
+// of every listener, see limitListener
+type connLimiter struct {
+	allow         []netip.Prefix
+	deny          []netip.Prefix
+	maxConns      int
+	maxConnsPerIP int
+	mu            sync.Mutex
+	total         int
+	perIP         map[netip.Addr]int
+	rejected      atomic.Uint64
+}
+
+func newConnLimiter(cfg ServerConfig) (*connLimiter, error) {
+	l := &connLimiter{perIP: make(map[netip.Addr]int)}
+	if err := l.update(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// update replace the lists and limits, the established connections are
+// still counted
+func (l *connLimiter) update(cfg ServerConfig) error {
+	allow, err := proxyproto.ParsePrefixes(cfg.AllowCIDRs)
+	if err != nil {
+		return err
+	}
+	deny, err := proxyproto.ParsePrefixes(cfg.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.allow = allow
+	l.deny = deny
+	l.maxConns = cfg.MaxConns
+	l.maxConnsPerIP = cfg.MaxConnsPerIP
+	return nil
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denied reports whether ip is denied by the ip lists, the caller must
+// hold l.mu when l is shared
+func (l *connLimiter) denied(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	return contains(l.deny, ip) || (len(l.allow) > 0 && !contains(l.allow, ip))
+}
+
+// remoteIP returns the ip of the address, it is not valid for non ip
+// addresses, e.g. pipes
+func remoteIP(addr net.Addr) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// acquire check the lists and limits for the connection from addr, the
+// returned release func must be called when the connection is closed
+func (l *connLimiter) acquire(addr net.Addr) (func(), error) {
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.denied(ip) {
+		l.rejected.Add(1)
+		return nil, errDenied
+	}
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		l.rejected.Add(1)
+		return nil, errTooManyConns
+	}
+	if ip.IsValid() && l.maxConnsPerIP > 0 && l.perIP[ip] >= l.maxConnsPerIP {
+		l.rejected.Add(1)
+		return nil, errTooManyConnsPerIP
+	}
+	l.total++
+	if ip.IsValid() {
+		l.perIP[ip]++
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.total--
+		if !ip.IsValid() {
+			return
+		}
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}, nil
+}
+
+// limitListener applies the ip lists and connection limits before the
+// connections are sniffed by the mux or served, rejected connections are
+// closed in the accept loop. Connections from trusted proxies are checked
+// on first use with the address in the PROXY protocol header.
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c := &limitConn{Conn: conn, limiter: l.limiter}
+		if pc, ok := conn.(*proxyproto.Conn); ok {
+			if pc.Trusted() {
+				return c, nil
+			}
+			// RemoteAddr of the untrusted ones waits for the header
+			conn = pc.Conn
+		}
+		c.once.Do(func() {
+			c.release, c.err = l.limiter.acquire(conn.RemoteAddr())
+		})
+		if c.err != nil {
+			logging.Info("reject %s: %v", conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// limitConn connection counted by connLimiter until it is closed
+type limitConn struct {
+	net.Conn
+	limiter *connLimiter
+	once    sync.Once
+	err     error
+	mu      sync.Mutex
+	release func()
+	closed  bool
+}
+
+func (c *limitConn) acquire() error {
+	c.once.Do(func() {
+		release, err := c.limiter.acquire(c.Conn.RemoteAddr())
+		if err != nil {
+			logging.Info("reject %s: %v", c.Conn.RemoteAddr(), err)
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			release()
+			c.err = net.ErrClosed
+			return
+		}
+		c.release = release
+	})
+	return c.err
+}
+
+// Read read data
+func (c *limitConn) Read(p []byte) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// Write write data
+func (c *limitConn) Write(p []byte) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// Close close connection and stop counting it
+func (c *limitConn) Close() error {
+	c.mu.Lock()
+	release := c.release
+	c.release = nil
+	c.closed = true
+	c.mu.Unlock()
+	if release != nil {
+		release()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,291 @@
+package crpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/compress"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l, err := newConnLimiter(ServerConfig{
+		AllowCIDRs:    []string{"10.0.0.0/8"},
+		DenyCIDRs:     []string{"10.0.0.1"},
+		MaxConns:      3,
+		MaxConnsPerIP: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	for _, ip := range []string{"10.0.0.1", "192.168.1.1"} {
+		if _, err := l.acquire(addr(ip)); err != errDenied {
+			t.Fatalf("%s: %v", ip, err)
+		}
+	}
+	var releases []func()
+	for _, ip := range []string{"10.0.0.2", "10.0.0.2", "10.0.0.3"} {
+		release, err := l.acquire(addr(ip))
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := l.acquire(addr("10.0.0.4")); err != errTooManyConns {
+		t.Fatalf("max conns: %v", err)
+	}
+	releases[2]()
+	if _, err := l.acquire(addr("10.0.0.2")); err != errTooManyConnsPerIP {
+		t.Fatalf("max conns per ip: %v", err)
+	}
+	if _, err := l.acquire(addr("10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.rejected.Load(); n != 4 {
+		t.Fatalf("unexpected rejected count: %d", n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		Compresser: compress.New(compress.Gzip),
+		OnRequest:  reply("ok"),
+		Limits: Limits{
+			MaxMessageSize: 4096,
+			MaxBodySize:    32,
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Compresser: compress.New(compress.Gzip),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	post := func(size int) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost/ping",
+			bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		return cli.Call(ctx, req)
+	}
+	rep, err := post(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status: %d", rep.StatusCode)
+	}
+	// decompression bomb is answered without closing the connection
+	rep, err = post(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status of decompression bomb: %d", rep.StatusCode)
+	}
+	if data, err := call(cli); err != nil || data != "ok" {
+		t.Fatalf("call after dropped message: %s, %v", data, err)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	svr, addr := newTestServer(t, ServerConfig{
+		DenyCIDRs: []string{"127.0.0.1"},
+		HTTPHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("http"))
+		}),
+	})
+	// denied before being sniffed by the mux
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("denied connection served")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("denied connection held open")
+	}
+	// http connections on the shared port are limited too
+	cli := &http.Client{Timeout: time.Second}
+	if _, err := cli.Get("http://" + addr + "/"); err == nil {
+		t.Fatal("denied http connection served")
+	}
+	if n := svr.Rejected(); n != 2 {
+		t.Fatalf("unexpected rejected count: %d", n)
+	}
+}
+
+func TestLimitTrustedProxy(t *testing.T) {
+	svr, addr := newTestServer(t, ServerConfig{
+		TrustedProxies: []string{"127.0.0.1"},
+		DenyCIDRs:      []string{"10.0.0.0/8"},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// checked with the address in the header
+	if _, err := conn.Write([]byte("PROXY TCP4 10.0.0.1 127.0.0.1 56324 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("denied connection served")
+	}
+	if n := svr.Rejected(); n != 1 {
+		t.Fatalf("unexpected rejected count: %d", n)
+	}
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		Compresser: compress.New(compress.Gzip),
+		OnRequest:  reply(strings.Repeat("x", 1<<20)),
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Compresser: compress.New(compress.Gzip),
+		Limits:     Limits{MaxMessageSize: 4096},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := call(cli); err != ErrMessageTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		Limits: Limits{MaxHeaderCount: 8},
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			rep, err := reply("ok")(r)
+			rep.Header = make(http.Header)
+			rep.Header.Set("X-Padding", strings.Repeat("x", 256))
+			return rep, err
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Limits: Limits{MaxHeaderBytes: 256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/ping", nil)
+	for i := range 8 {
+		req.Header.Set(fmt.Sprintf("X-Header-%d", i), "x")
+	}
+	rep, err := cli.Call(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("unexpected status: %d", rep.StatusCode)
+	}
+	// the response headers are larger than the limit of the client
+	if _, err := call(cli); err != codec.ErrHeaderTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxPendingCalls(t *testing.T) {
+	release := make(chan struct{})
+	_, addr := newTestServer(t, ServerConfig{
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			<-release
+			return reply("ok")(r)
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Limits: Limits{MaxPendingCalls: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	const calls = 16
+	errs := make(chan error, calls)
+	for range calls {
+		go func() {
+			_, err := call(cli)
+			errs <- err
+		}()
+	}
+	rejected := 0
+	for rejected < calls-2 {
+		select {
+		case err := <-errs:
+			if err != ErrTooManyPendingCalls {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			rejected++
+		case <-time.After(time.Second):
+			t.Fatalf("only %d calls rejected", rejected)
+		}
+	}
+	close(release)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBodyTooLargeUnknownLength(t *testing.T) {
+	var calls atomic.Int64
+	_, addr := newTestServer(t, ServerConfig{
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return reply("ok")(r)
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Limits: Limits{MaxBodySize: 32},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	post := func(size int) error {
+		// the length of a MultiReader is unknown
+		body := io.MultiReader(bytes.NewReader(make([]byte, size)))
+		req, err := http.NewRequest(http.MethodPost, "http://localhost/ping", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = cli.Call(ctx, req)
+		return err
+	}
+	if err := post(64); err != ErrBodyTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls.Load() != 0 {
+		t.Fatal("oversized body sent")
+	}
+	if err := post(16); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,230 @@
+// Package jwt verifies bearer tokens in the Authorization header of crpc
+// requests, HS256, RS256 and ES256 are supported
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lwch/crpc"
+	"github.com/lwch/logging"
+)
+
+var errMissingToken = errors.New("jwt: missing bearer token")
+var errMalformed = errors.New("jwt: malformed token")
+var errAlgorithm = errors.New("jwt: unsupported algorithm")
+var errNoKey = errors.New("jwt: no key for token")
+var errSignature = errors.New("jwt: invalid signature")
+var errExpired = errors.New("jwt: token is expired")
+var errNotValidYet = errors.New("jwt: token is not valid yet")
+var errMissingExp = errors.New("jwt: missing exp claim")
+var errInvalidTime = errors.New("jwt: invalid time claim")
+var errIssuer = errors.New("jwt: invalid issuer")
+var errAudience = errors.New("jwt: invalid audience")
+
+// Claims claims of the token
+type Claims map[string]any
+
+// Config verify config
+type Config struct {
+	// Keys verification keys, see NewKeySet and LoadJWKS
+	Keys *KeySet
+	// Issuer expected iss claim, it is not checked when empty
+	Issuer string
+	// Audience expected aud claim, it is not checked when empty
+	Audience string
+	// Leeway allowed clock skew for exp and nbf
+	Leeway time.Duration
+	// RequireExp rejects the tokens without exp claim, they never expire
+	// otherwise
+	RequireExp bool
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the verified token
+func ClaimsFromContext(ctx context.Context) Claims {
+	claims, _ := ctx.Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// Middleware verifies the bearer token of every request before calling
+// next, invalid requests are rejected with 401
+func Middleware(cfg Config, next crpc.RequestHandlerFunc) crpc.RequestHandlerFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return unauthorized(errMissingToken), nil
+		}
+		claims, err := Verify(cfg, token)
+		if err != nil {
+			logging.Info("jwt: reject %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			return unauthorized(err), nil
+		}
+		return next(r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+func unauthorized(err error) *http.Response {
+	hdr := make(http.Header)
+	hdr.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     hdr,
+		Body:       io.NopCloser(strings.NewReader(err.Error())),
+	}
+}
+
+// Verify verify the token and returns its claims
+func Verify(cfg Config, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	var hdr header
+	if err := decode(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+	if err := cfg.Keys.verify(hdr, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decode(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := cfg.check(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decode(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	return nil
+}
+
+func (cfg Config) check(claims Claims) error {
+	now := time.Now()
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok && cfg.RequireExp {
+		return errMissingExp
+	}
+	if ok && now.After(exp.Add(cfg.Leeway)) {
+		return errExpired
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Before(nbf.Add(-cfg.Leeway)) {
+		return errNotValidYet
+	}
+	if cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != cfg.Issuer {
+			return errIssuer
+		}
+	}
+	if cfg.Audience != "" && !hasAudience(claims["aud"], cfg.Audience) {
+		return errAudience
+	}
+	return nil
+}
+
+// numericDate returns the time of the claim, ok is false when it is
+// missing, any other value than a number is an error
+func numericDate(claims Claims, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: %s", errInvalidTime, name)
+	}
+	return time.Unix(int64(n), 0), true, nil
+}
+
+func hasAudience(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key any, data, sig []byte) error {
+	hash := sha256.Sum256(data)
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errNoKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errSignature
+		}
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errNoKey
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return errSignature
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != "P-256" {
+			return errNoKey
+		}
+		if len(sig) != 64 {
+			return errSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return errSignature
+		}
+	default:
+		return errAlgorithm
+	}
+	return nil
+}
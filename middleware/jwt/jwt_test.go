@@ -0,0 +1,130 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, alg, kid string, key any, claims Claims) string {
+	enc := base64.RawURLEncoding
+	hdr, _ := json.Marshal(header{Alg: alg, Kid: kid})
+	body, _ := json.Marshal(claims)
+	data := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	hash := sha256.Sum256([]byte(data))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(data))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, hash[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		err = e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data + "." + enc.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("crpc jwt secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"oct","kid":"hs","k":"%s"},
+		{"kty":"RSA","kid":"rs","n":"%s","e":"AQAB"},
+		{"kty":"EC","kid":"es","crv":"P-256","x":"%s","y":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(secret),
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))))
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Keys: keys, Issuer: "crpc", Audience: "api", RequireExp: true}
+	now := time.Now().Unix()
+	valid := Claims{"iss": "crpc", "aud": []any{"api"}, "exp": now + 60, "sub": "alice"}
+	for _, tc := range []struct {
+		alg, kid string
+		key      any
+	}{
+		{"HS256", "hs", secret},
+		{"RS256", "rs", rsaKey},
+		{"ES256", "es", ecKey},
+		{"ES256", "", ecKey},
+	} {
+		claims, err := Verify(cfg, sign(t, tc.alg, tc.kid, tc.key, valid))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.alg, err)
+		}
+		if claims["sub"] != "alice" {
+			t.Fatalf("%s: invalid claims", tc.alg)
+		}
+	}
+	for name, token := range map[string]string{
+		"expired":   sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api", "exp": now - 60}),
+		"nbf":       sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api", "nbf": now + 60}),
+		"issuer":    sign(t, "HS256", "hs", secret, Claims{"iss": "other", "aud": "api", "exp": now + 60}),
+		"audience":  sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "other", "exp": now + 60}),
+		"signature": sign(t, "HS256", "hs", []byte("wrong"), valid),
+		"no exp":    sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api"}),
+		"exp text":  sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api", "exp": "1"}),
+		"exp null":  sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api", "exp": nil}),
+		"nbf text":  sign(t, "HS256", "hs", secret, Claims{"iss": "crpc", "aud": "api", "exp": now + 60, "nbf": "1"}),
+		// hmac signed with the public rsa modulus must not be accepted
+		"confusion": sign(t, "HS256", "rs", rsaKey.N.Bytes(), valid),
+	} {
+		if _, err := Verify(cfg, token); err == nil {
+			t.Fatalf("%s: invalid token accepted", name)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := NewKeySet()
+	keys.AddHMAC("hs", []byte("crpc jwt secret"))
+	handler := Middleware(Config{Keys: keys}, func(r *http.Request) (*http.Response, error) {
+		if ClaimsFromContext(r.Context())["sub"] != "alice" {
+			t.Fatal("claims not in context")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/ping", nil)
+	resp, _ := handler(req)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", "hs", []byte("crpc jwt secret"), Claims{"sub": "alice"}))
+	resp, _ = handler(req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", "hs", []byte("crpc jwt secret"), Claims{"sub": "alice", "exp": "1"}))
+	resp, _ = handler(req)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,158 @@
+package jwt
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+var errKeyType = errors.New("jwt: unsupported key type")
+
+// KeySet verification keys by key id
+type KeySet struct {
+	keys map[string]any
+}
+
+// NewKeySet create key set
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]any)}
+}
+
+// AddHMAC add HS256 secret
+func (ks *KeySet) AddHMAC(kid string, secret []byte) {
+	ks.keys[kid] = secret
+}
+
+// AddRSA add RS256 public key
+func (ks *KeySet) AddRSA(kid string, key *rsa.PublicKey) {
+	ks.keys[kid] = key
+}
+
+// AddECDSA add ES256 public key
+func (ks *KeySet) AddECDSA(kid string, key *ecdsa.PublicKey) {
+	ks.keys[kid] = key
+}
+
+// verify verify with the key of the kid, or every key when the token has
+// no kid, the algorithm must match the key type
+func (ks *KeySet) verify(hdr header, data, sig []byte) error {
+	if ks == nil {
+		return errNoKey
+	}
+	if hdr.Kid != "" {
+		key, ok := ks.keys[hdr.Kid]
+		if !ok {
+			return errNoKey
+		}
+		return verifySignature(hdr.Alg, key, data, sig)
+	}
+	err := errNoKey
+	for _, key := range ks.keys {
+		e := verifySignature(hdr.Alg, key, data, sig)
+		if e == nil {
+			return nil
+		}
+		if !errors.Is(e, errNoKey) {
+			err = e
+		}
+	}
+	return err
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// LoadJWKS load key set from JWKS file
+func LoadJWKS(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parse JWKS document, RSA, P-256 EC and oct keys are supported
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	ks := NewKeySet()
+	for _, k := range doc.Keys {
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %q: %w", k.Kid, err)
+		}
+		ks.keys[k.Kid] = key
+	}
+	return ks, nil
+}
+
+func (k jwk) parse() (any, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "oct":
+		return dec.DecodeString(k.K)
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errKeyType
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errKeyType
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errKeyType
+		}
+		// validate the point is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, errKeyType
+	}
+}
@@ -21,6 +21,7 @@ var errBufferTooShort = errors.New("network: buffer too short")
 var errInvalidPacketChecksum = errors.New("network: invalid packet checksum")
 var errOpenStreamDone = errors.New("network: open stream done")
 var errStreamNotFound = errors.New("network: stream not found")
+var errConnClosed = errors.New("network: connection closed")
 
 const (
 	flagData          = 0
@@ -30,8 +31,13 @@ const (
 	flagStreamData    = 1 << 28 // 29位表示数据传输
 	flagPing          = 1 << 27 // 28位表示ping请求
 	flagPong          = 1 << 26 // 27位表示pong响应
+	flagStreamOpener  = 1 << 25 // 26位表示发送方为stream的打开方
 )
 
+// openedKey 本端打开的stream的id由对端分配，与本端accept的stream的id
+// 可能重复，因此在streams中使用不同的key
+const openedKey = 1 << 24
+
 type writeArgs struct {
 	flag uint32
 	data []byte
@@ -52,12 +58,14 @@ type Conn struct {
 	chWrite        chan writeArgs
 	chWriteControl chan writeControlArgs
 	// stream
-	streams        map[uint32]*Stream
-	mStreams       sync.RWMutex
-	chStreamOpened chan *Stream
+	streams          map[uint32]*Stream
+	mStreams         sync.RWMutex
+	chStreamAccepted chan *Stream
+	chStreamOpened   chan *Stream
 	// runtime
-	err error
-	ctx context.Context
+	err  error
+	mErr sync.Mutex
+	ctx  context.Context
 }
 
 // 封包格式
@@ -66,10 +74,11 @@ type Conn struct {
 // +-------------+---------+----------+---------+---------+
 // Flag字段格式
 // +---------+------------+----------+---------+---------+---------+-----------+---------------+
-// | Open(1) | OpenAck(1) | Close(1) | Data(1) | Ping(1) | Pong(1) | Unused(2) | Stream ID(24) |
-// +---------+------------+----------+---------+---------+---------+-----------+---------------+
-// 高6位为标志位，后2位暂未使用，低24位为stream id
-// Stream ID由Accept方进行分配，在Open请求中Stream ID为0
+// | Open(1) | OpenAck(1) | Close(1) | Data(1) | Ping(1) | Pong(1) | Opener(1) | Unused(1) | Stream ID(24) |
+// +---------+------------+----------+---------+---------+---------+-----------+-----------+---------------+
+// 高6位为标志位，Opener位表示该stream由发送方打开，最后1位暂未使用，低24位为stream id
+// Stream ID由Accept方进行分配，在Open请求中Stream ID为0，两端均可打开stream，
+// 接收方根据Opener位区分该id是由本端还是对端分配的
 
 type header struct {
 	Sequence uint64
@@ -82,13 +91,14 @@ type header struct {
 func New(conn net.Conn) *Conn {
 	ctx, cancel := context.WithCancel(context.Background())
 	ret := &Conn{
-		conn:           conn,
-		chRead:         make(chan []byte, 10000),
-		chWrite:        make(chan writeArgs, 10000),
-		chWriteControl: make(chan writeControlArgs, 100),
-		streams:        make(map[uint32]*Stream),
-		chStreamOpened: make(chan *Stream),
-		ctx:            ctx,
+		conn:             conn,
+		chRead:           make(chan []byte, 10000),
+		chWrite:          make(chan writeArgs, 10000),
+		chWriteControl:   make(chan writeControlArgs, 100),
+		streams:          make(map[uint32]*Stream),
+		chStreamAccepted: make(chan *Stream, 100),
+		chStreamOpened:   make(chan *Stream, 100),
+		ctx:              ctx,
 	}
 	go ret.loopRead(cancel)
 	go ret.loopWrite(cancel)
@@ -101,12 +111,36 @@ func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
+// closedErr returns the error the connection is closed with
+func (c *Conn) closedErr() error {
+	c.mErr.Lock()
+	defer c.mErr.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return errConnClosed
+}
+
+// setErr keeps the first error of loopRead and loopWrite
+func (c *Conn) setErr(err error) {
+	c.mErr.Lock()
+	defer c.mErr.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// RemoteAddr returns remote address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
 // AcceptStream accept stream
 func (c *Conn) AcceptStream() (*Stream, error) {
 	select {
 	case <-c.ctx.Done():
-		return nil, c.err
-	case stream := <-c.chStreamOpened:
+		return nil, c.closedErr()
+	case stream := <-c.chStreamAccepted:
 		return stream, nil
 	}
 }
@@ -121,7 +155,7 @@ func (c *Conn) OpenStream(ctx context.Context) (*Stream, error) {
 	case <-ctx.Done():
 		return nil, errOpenStreamDone
 	case <-c.ctx.Done():
-		return nil, c.err
+		return nil, c.closedErr()
 	case stream := <-c.chStreamOpened:
 		return stream, nil
 	}
@@ -145,7 +179,7 @@ func (c *Conn) Write(p []byte) (int, error) {
 func (c *Conn) Read(p []byte) (int, error) {
 	select {
 	case <-c.ctx.Done():
-		return 0, c.err
+		return 0, c.closedErr()
 	case data := <-c.chRead:
 		if len(p) < len(data) {
 			return 0, errBufferTooShort
@@ -201,7 +235,7 @@ func (c *Conn) onClose(err error) {
 func (c *Conn) loopRead(cancel context.CancelFunc) {
 	var err error
 	defer func() {
-		c.err = err
+		c.setErr(err)
 		cancel()
 	}()
 	defer c.onClose(err)
@@ -270,7 +304,7 @@ func (c *Conn) loopRead(cancel context.CancelFunc) {
 func (c *Conn) loopWrite(cancel context.CancelFunc) {
 	var err error
 	defer func() {
-		c.err = err
+		c.setErr(err)
 		cancel()
 	}()
 	defer c.onClose(err)
@@ -332,11 +366,21 @@ func (c *Conn) writeControl(flag uint32) error {
 	return nil
 }
 
-func (c *Conn) getStream(stream uint32) *Stream {
-	stream = stream & 0xffffff
+// getStream find the stream of the received flag, streams opened by the
+// sender are accepted by this side, peers of old versions never set the
+// opener flag so the other namespace is looked up as a fallback
+func (c *Conn) getStream(flag uint32) *Stream {
+	id := flag & 0xffffff
+	key, other := id|openedKey, id
+	if flag&flagStreamOpener != 0 {
+		key, other = id, id|openedKey
+	}
 	c.mStreams.RLock()
 	defer c.mStreams.RUnlock()
-	return c.streams[stream]
+	if s := c.streams[key]; s != nil {
+		return s
+	}
+	return c.streams[other]
 }
 
 // SendKeepalive send keepalive packet
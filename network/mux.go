@@ -0,0 +1,153 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lwch/logging"
+)
+
+// sniffTimeout is longer than the keepalive interval so that idle crpc
+// peers are always identified by their first ping
+const sniffTimeout = 30 * time.Second
+
+// Mux splits connections accepted from one listener into crpc and http
+// connections by sniffing the first byte, http requests always start with
+// an upper case method name while crpc frames start with the high byte of
+// the sequence
+type Mux struct {
+	l         net.Listener
+	crpc      *muxListener
+	http      *muxListener
+	closeOnce sync.Once
+	// sniffTimeout closes the connections sending nothing in time
+	sniffTimeout time.Duration
+}
+
+type muxListener struct {
+	addr   net.Addr
+	ch     chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewMux create mux on listener
+func NewMux(l net.Listener) *Mux {
+	return &Mux{
+		l:            l,
+		crpc:         newMuxListener(l.Addr()),
+		http:         newMuxListener(l.Addr()),
+		sniffTimeout: sniffTimeout,
+	}
+}
+
+// CRPC returns the listener of crpc connections
+func (m *Mux) CRPC() net.Listener {
+	return m.crpc
+}
+
+// HTTP returns the listener of http connections
+func (m *Mux) HTTP() net.Listener {
+	return m.http
+}
+
+// Serve accept and dispatch connections until the listener closed
+func (m *Mux) Serve() error {
+	defer m.Close()
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logging.Error("mux accept: %v", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go m.dispatch(conn)
+	}
+}
+
+// Close close the listener and both sub listeners
+func (m *Mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		err = m.l.Close()
+		m.crpc.Close()
+		m.http.Close()
+	})
+	return err
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	var b [1]byte
+	conn.SetReadDeadline(time.Now().Add(m.sniffTimeout))
+	_, err := conn.Read(b[:])
+	if err != nil {
+		logging.Error("mux sniff => %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	pc := &peekConn{Conn: conn, peek: b[:]}
+	if b[0] >= 'A' && b[0] <= 'Z' {
+		m.http.push(pc)
+		return
+	}
+	m.crpc.push(pc)
+}
+
+func newMuxListener(addr net.Addr) *muxListener {
+	return &muxListener{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *muxListener) push(conn net.Conn) {
+	select {
+	case l.ch <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept accept connection
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close close listener
+func (l *muxListener) Close() error {
+	l.closed.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns listener address
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
+
+type peekConn struct {
+	net.Conn
+	peek []byte
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	if len(c.peek) > 0 {
+		n := copy(p, c.peek)
+		c.peek = c.peek[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMux(t *testing.T) (*Mux, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMux(l)
+	m.sniffTimeout = 100 * time.Millisecond
+	go m.Serve()
+	t.Cleanup(func() { m.Close() })
+	return m, l.Addr().String()
+}
+
+func accept(t *testing.T, l net.Listener) net.Conn {
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			ch <- conn
+		}
+	}()
+	select {
+	case conn := <-ch:
+		return conn
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestMux(t *testing.T) {
+	m, addr := newTestMux(t)
+	for _, c := range []struct {
+		data string
+		l    net.Listener
+	}{
+		{"GET / HTTP/1.1\r\n", m.HTTP()},
+		{"\x00\x00\x00\x01", m.CRPC()},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, c.data); err != nil {
+			t.Fatal(err)
+		}
+		accepted := accept(t, c.l)
+		if accepted == nil {
+			t.Fatalf("%q not dispatched", c.data)
+		}
+		defer accepted.Close()
+		// the sniffed byte is read again
+		buf := make([]byte, len(c.data))
+		if _, err := io.ReadFull(accepted, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != c.data {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	}
+}
+
+func TestMuxSniffTimeout(t *testing.T) {
+	m, addr := newTestMux(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent connection not closed: %v", err)
+	}
+	if accept(t, m.CRPC()) != nil {
+		t.Fatal("silent connection dispatched")
+	}
+}
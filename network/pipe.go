@@ -0,0 +1,92 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
+
+type pipeConn struct {
+	r         io.ReadCloser
+	w         io.WriteCloser
+	addr      pipeAddr
+	closeOnce sync.Once
+	err       error
+}
+
+// NewPipe create a net.Conn on a reader and a writer, e.g. the stdin and
+// stdout of a process, deadlines are supported when they are *os.File
+func NewPipe(r io.ReadCloser, w io.WriteCloser, name string) net.Conn {
+	return &pipeConn{
+		r:    r,
+		w:    w,
+		addr: pipeAddr(name),
+	}
+}
+
+// Read read data
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write write data
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close close both reader and writer
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		err := c.w.Close()
+		if err2 := c.r.Close(); err == nil {
+			err = err2
+		}
+		c.err = err
+	})
+	return c.err
+}
+
+// LocalAddr returns pipe name
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns pipe name
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline set read and write deadline
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline set read deadline
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if r, ok := c.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return r.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline set write deadline
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	if w, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return w.SetWriteDeadline(t)
+	}
+	return nil
+}
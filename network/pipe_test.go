@@ -0,0 +1,62 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// newPipes returns two connected pipe conns
+func newPipes(t *testing.T) (*pipeConn, *pipeConn) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewPipe(r1, w2, "a").(*pipeConn)
+	b := NewPipe(r2, w1, "b").(*pipeConn)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestPipe(t *testing.T) {
+	a, b := newPipes(t)
+	if a.LocalAddr().String() != "a" || a.RemoteAddr().Network() != "pipe" {
+		t.Fatalf("unexpected addr: %v", a.LocalAddr())
+	}
+	go a.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+	// closing a ends the stream of b
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("close twice: %v", err)
+	}
+}
+
+func TestPipeDeadline(t *testing.T) {
+	a, _ := newPipes(t)
+	a.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var errInvalidHeader = errors.New("proxyproto: invalid header")
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1最大长度为107字节，包括结尾的\r\n
+const v1MaxLength = 107
+
+const (
+	v2CmdLocal  = 0x20
+	v2CmdProxy  = 0x21
+	v2FamTCP4   = 0x11
+	v2FamTCP6   = 0x21
+	v2HeaderLen = 16
+)
+
+// parseV1 parse text header, e.g. PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, nil, errInvalidHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errInvalidHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, errInvalidHeader
+	}
+	src, err := parseAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseAddr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, errInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errInvalidHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// parseV2 parse binary header
+// +---------------+-----------+-----------+--------+-----------+
+// | Signature(12) | VerCmd(1) | Family(1) | Len(2) | Addresses |
+// +---------------+-----------+-----------+--------+-----------+
+func parseV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[14:]))
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] {
+	case v2CmdLocal:
+		// health check from the proxy itself
+		return nil, nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, nil, errInvalidHeader
+	}
+	var ipLen int
+	switch hdr[13] {
+	case v2FamTCP4:
+		ipLen = 4
+	case v2FamTCP6:
+		ipLen = 16
+	default:
+		// unix sockets and udp are not relevant for a tcp server
+		return nil, nil, nil
+	}
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, errInvalidHeader
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : ipLen*2])
+	srcPort := binary.BigEndian.Uint16(payload[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(payload[ipLen*2+2:])
+	src := net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	dst := net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return src, dst, nil
+}
@@ -0,0 +1,227 @@
+// Package proxyproto implements a listener that parses HAProxy PROXY
+// protocol v1 and v2 headers, so RemoteAddr returns the real client
+// address behind a tcp load balancer.
+//
+// Only connections from trusted sources may send the header, it is
+// optional for them, a connection from any other source that sends a
+// header is rejected.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUntrusted = errors.New("proxyproto: header from untrusted source")
+
+// ReadHeaderTimeout max duration to wait for the header
+var ReadHeaderTimeout = 5 * time.Second
+
+type listener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// NewListener wraps l, the PROXY protocol header is accepted only from
+// the trusted prefixes
+func NewListener(l net.Listener, trusted []netip.Prefix) net.Listener {
+	return &listener{
+		Listener: l,
+		trusted:  trusted,
+	}
+}
+
+// ParsePrefixes parse CIDRs or single ip addresses
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(list))
+	for _, str := range list {
+		str = strings.TrimSpace(str)
+		if strings.Contains(str, "/") {
+			prefix, err := netip.ParsePrefix(str)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return ret, nil
+}
+
+// Accept accept connection, the header is parsed lazily on first use so
+// that a slow peer does not block the accept loop
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		trusted: l.isTrusted(conn.RemoteAddr()),
+	}, nil
+}
+
+func (l *listener) isTrusted(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn connection with PROXY protocol header parsed
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted bool
+	once    sync.Once
+	err     error
+	src     net.Addr
+	dst     net.Addr
+	// read deadline set by the caller, restored after the header is read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) init() error {
+	c.once.Do(func() {
+		deadline := time.Now().Add(ReadHeaderTimeout)
+		if d := c.deadline(); !d.IsZero() && d.Before(deadline) {
+			deadline = d
+		}
+		c.Conn.SetReadDeadline(deadline)
+		defer func() {
+			c.Conn.SetReadDeadline(c.deadline())
+		}()
+		version, err := c.detect()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// nothing sent yet, so there is no header
+				return
+			}
+			c.err = err
+			return
+		}
+		if version == 0 {
+			return
+		}
+		if !c.trusted {
+			c.err = fmt.Errorf("%w: %s", errUntrusted, c.Conn.RemoteAddr().String())
+			return
+		}
+		if version == 1 {
+			c.src, c.dst, c.err = parseV1(c.r)
+		} else {
+			c.src, c.dst, c.err = parseV2(c.r)
+		}
+		if c.err == io.EOF {
+			// closed in the middle of the header
+			c.err = io.ErrUnexpectedEOF
+		}
+		if errors.Is(c.err, os.ErrDeadlineExceeded) {
+			c.err = fmt.Errorf("proxyproto: read header: %w", c.err)
+		}
+	})
+	return c.err
+}
+
+func (c *Conn) deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readDeadline
+}
+
+// SetDeadline set read and write deadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline set read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// detect returns the header version or 0 when there is no header
+func (c *Conn) detect() (int, error) {
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		b, err = c.r.Peek(len(v1Prefix))
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(b, v1Prefix) {
+			return 1, nil
+		}
+	case v2Signature[0]:
+		b, err = c.r.Peek(len(v2Signature))
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(b, v2Signature) {
+			return 2, nil
+		}
+	}
+	return 0, nil
+}
+
+// Trusted reports whether the connection is from a trusted source, which
+// may send a header
+func (c *Conn) Trusted() bool {
+	return c.trusted
+}
+
+// Read read data after the header
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header
+func (c *Conn) LocalAddr() net.Addr {
+	if c.init() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,172 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+// accept sends data to a listener trusting the given prefixes and returns
+// the accepted connection
+func accept(t *testing.T, trusted []string, data []byte) net.Conn {
+	prefixes, err := ParsePrefixes(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	l = NewListener(l, prefixes)
+	cli, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	if _, err := cli.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// the header may be truncated by closing the write side
+	cli.(*net.TCPConn).CloseWrite()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, cmd, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func v2Addrs(src, dst string) []byte {
+	s := netip.MustParseAddrPort(src)
+	d := netip.MustParseAddrPort(dst)
+	ret := append(s.Addr().AsSlice(), d.Addr().AsSlice()...)
+	ret = binary.BigEndian.AppendUint16(ret, s.Port())
+	return binary.BigEndian.AppendUint16(ret, d.Port())
+}
+
+func TestHeader(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		header []byte
+		src    string
+		dst    string
+	}{
+		{"none", nil, "", ""},
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"),
+			"192.168.0.1:56324", "192.168.0.11:443"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v2 tcp4", v2Header(v2CmdProxy, v2FamTCP4, v2Addrs("10.0.0.1:1234", "10.0.0.2:443")),
+			"10.0.0.1:1234", "10.0.0.2:443"},
+		{"v2 tcp6", v2Header(v2CmdProxy, v2FamTCP6, v2Addrs("[2001:db8::1]:1234", "[2001:db8::2]:443")),
+			"[2001:db8::1]:1234", "[2001:db8::2]:443"},
+		{"v2 local", v2Header(v2CmdLocal, 0, nil), "", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := accept(t, []string{"127.0.0.1"}, append(c.header, "data"...))
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "data" {
+				t.Fatalf("unexpected data: %q", data)
+			}
+			src, dst := c.src, c.dst
+			if src == "" {
+				src = conn.(*Conn).Conn.RemoteAddr().String()
+				dst = conn.(*Conn).Conn.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != src || conn.LocalAddr().String() != dst {
+				t.Fatalf("unexpected addr: %s => %s", conn.RemoteAddr(), conn.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		header []byte
+	}{
+		{"v1 truncated", []byte("PROXY TCP4 192.168.0.1")},
+		{"v1 invalid ip", []byte("PROXY TCP4 192.168.0 192.168.0.11 56324 443\r\n")},
+		{"v1 invalid port", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n")},
+		{"v1 invalid protocol", []byte("PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n")},
+		{"v1 too long", append([]byte("PROXY TCP4 "), make([]byte, v1MaxLength)...)},
+		{"v2 truncated", v2Header(v2CmdProxy, v2FamTCP4, v2Addrs("10.0.0.1:1234", "10.0.0.2:443"))[:20]},
+		{"v2 invalid command", v2Header(0x22, v2FamTCP4, v2Addrs("10.0.0.1:1234", "10.0.0.2:443"))},
+		{"v2 short addresses", v2Header(v2CmdProxy, v2FamTCP4, make([]byte, 8))},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := accept(t, []string{"127.0.0.0/8"}, c.header)
+			if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+				t.Fatalf("invalid header accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestUntrusted(t *testing.T) {
+	header := []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+	conn := accept(t, []string{"10.0.0.0/8"}, append(header, "data"...))
+	if _, err := conn.Read(make([]byte, 4)); !errors.Is(err, errUntrusted) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn.RemoteAddr().String() == "192.168.0.1:56324" {
+		t.Fatal("untrusted address used")
+	}
+	// connections without header are served
+	conn = accept(t, []string{"10.0.0.0/8"}, []byte("data"))
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "data" {
+		t.Fatalf("read: %q, %v", data, err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	prefixes, _ := ParsePrefixes([]string{"127.0.0.1"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l = NewListener(l, prefixes)
+	cli, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the deadline set before the header is read is kept
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(ReadHeaderTimeout + time.Second):
+		t.Fatal("read deadline overwritten by the header timeout")
+	}
+}
@@ -0,0 +1,555 @@
+package rudp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errDeadLink = errors.New("rudp: dead link")
+var errIdleTimeout = errors.New("rudp: idle timeout")
+
+const (
+	mtu         = 1200
+	mss         = mtu - headerSize
+	interval    = 10 * time.Millisecond
+	sndWnd      = 256 // 默认发送窗口，单位为分片
+	rcvWnd      = 256 // 接收窗口，单位为分片
+	minRto      = 30
+	maxRto      = 5000
+	deadLink    = 20 // 单个分片重传次数上限
+	fastResend  = 2  // 被跳过多少次后快速重传
+	closeRepeat = 3  // close分片发送次数
+	lingerTime  = 5 * time.Second
+)
+
+// Config config
+type Config struct {
+	// Drop returns true to drop an outgoing packet, used to simulate
+	// packet loss on lossy links
+	Drop func([]byte) bool
+	// IdleTimeout close the connection when nothing received within the
+	// duration, default is 30s
+	IdleTimeout time.Duration
+	// SendWindow send window in segments, default is 256
+	SendWindow int
+}
+
+func (cfg Config) idleTimeout() time.Duration {
+	if cfg.IdleTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return cfg.IdleTimeout
+}
+
+func (cfg Config) sendWindow() int {
+	if cfg.SendWindow <= 0 {
+		return sndWnd
+	}
+	return cfg.SendWindow
+}
+
+// Conn reliable udp connection, implements net.Conn
+type Conn struct {
+	conv   uint32
+	pc     net.PacketConn
+	local  net.Addr
+	remote net.Addr
+	cfg    Config
+	mu     sync.Mutex
+	// mWrite keeps the data of a Write contiguous when it waits for the
+	// send window, e.g. writes of network.Conn from several goroutines
+	mWrite sync.Mutex
+	start  time.Time
+	// send
+	sndNxt   uint32
+	sndQueue [][]byte
+	sndBuf   []*segment
+	rmtWnd   uint16
+	cwnd     float64
+	ssthresh float64
+	srtt     int64
+	rttvar   int64
+	rto      int64
+	// receive
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte
+	rcvQueue bytes.Buffer
+	acks     []*segment
+	lastRecv time.Time
+	// state
+	closing       bool
+	closingAt     time.Time
+	remoteClosed  bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	chReadable    chan struct{}
+	chWritable    chan struct{}
+	chFlush       chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+	onClose       func()
+}
+
+func newConn(conv uint32, pc net.PacketConn, remote net.Addr, cfg Config, onClose func()) *Conn {
+	now := time.Now()
+	c := &Conn{
+		conv:       conv,
+		pc:         pc,
+		local:      pc.LocalAddr(),
+		remote:     remote,
+		cfg:        cfg,
+		start:      now,
+		rmtWnd:     rcvWnd,
+		cwnd:       1,
+		ssthresh:   float64(cfg.sendWindow()),
+		rto:        200,
+		rcvBuf:     make(map[uint32][]byte),
+		lastRecv:   now,
+		chReadable: make(chan struct{}, 1),
+		chWritable: make(chan struct{}, 1),
+		chFlush:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		onClose:    onClose,
+	}
+	go c.loop()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) now() int64 {
+	return time.Since(c.start).Milliseconds()
+}
+
+// Read read data
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.rcvQueue.Len() > 0 {
+			n, _ := c.rcvQueue.Read(p)
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if c.closing {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.remoteClosed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err := wait(c.chReadable, c.done, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write write data, the data of a call is queued contiguously
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mWrite.Lock()
+	defer c.mWrite.Unlock()
+	var n int
+	for n < len(p) {
+		c.mu.Lock()
+		if c.err != nil || c.closing || c.remoteClosed {
+			err := c.err
+			if err == nil {
+				err = net.ErrClosed
+			}
+			c.mu.Unlock()
+			return n, err
+		}
+		for n < len(p) && len(c.sndQueue)+len(c.sndBuf) < c.cfg.sendWindow()*2 {
+			size := min(len(p)-n, mss)
+			c.sndQueue = append(c.sndQueue, bytes.Clone(p[n:n+size]))
+			n += size
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		notify(c.chFlush)
+		if n == len(p) {
+			break
+		}
+		if err := wait(c.chWritable, c.done, deadline); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func wait(ch, done chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-done:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Close close connection, pending data is still delivered in background
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing || c.err != nil {
+		return nil
+	}
+	c.closing = true
+	c.closingAt = time.Now()
+	notify(c.chFlush)
+	notify(c.chReadable)
+	notify(c.chWritable)
+	return nil
+}
+
+// LocalAddr returns local address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns remote address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline set read and write deadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	notify(c.chReadable)
+	notify(c.chWritable)
+	return nil
+}
+
+// SetReadDeadline set read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	notify(c.chReadable)
+	return nil
+}
+
+// SetWriteDeadline set write deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	notify(c.chWritable)
+	return nil
+}
+
+func (c *Conn) terminate(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *Conn) loop() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.chFlush:
+		}
+		c.flush()
+	}
+}
+
+// input handle one udp packet from remote
+func (c *Conn) input(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastRecv = time.Now()
+	var readable, writable bool
+	for len(data) > 0 {
+		seg, rest, err := decode(data)
+		if err != nil || seg.conv != c.conv {
+			return
+		}
+		data = rest
+		c.rmtWnd = seg.wnd
+		if c.ackUna(seg.una) {
+			writable = true
+		}
+		switch seg.cmd {
+		case cmdPush:
+			if c.handlePush(seg) {
+				readable = true
+			}
+		case cmdAck:
+			if c.handleAck(seg) {
+				writable = true
+			}
+		case cmdClose:
+			c.remoteClosed = true
+			readable = true
+		}
+	}
+	if readable {
+		notify(c.chReadable)
+	}
+	if writable {
+		notify(c.chWritable)
+	}
+	if len(c.acks) > 0 || writable {
+		notify(c.chFlush)
+	}
+}
+
+// ackUna removes all segments before una from send buffer
+func (c *Conn) ackUna(una uint32) bool {
+	var n int
+	for n < len(c.sndBuf) && before(c.sndBuf[n].seq, una) {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	c.sndBuf = c.sndBuf[n:]
+	c.grow(n)
+	return true
+}
+
+func (c *Conn) handlePush(seg *segment) bool {
+	if !before(seg.seq, c.rcvNxt+rcvWnd) {
+		return false
+	}
+	c.acks = append(c.acks, &segment{seq: seg.seq, ts: seg.ts})
+	if before(seg.seq, c.rcvNxt) {
+		return false
+	}
+	if _, ok := c.rcvBuf[seg.seq]; !ok {
+		c.rcvBuf[seg.seq] = bytes.Clone(seg.data)
+	}
+	var readable bool
+	for {
+		data, ok := c.rcvBuf[c.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(c.rcvBuf, c.rcvNxt)
+		c.rcvQueue.Write(data)
+		c.rcvNxt++
+		readable = true
+	}
+	return readable
+}
+
+func (c *Conn) handleAck(seg *segment) bool {
+	c.updateRtt(c.now() - int64(seg.ts))
+	for i, s := range c.sndBuf {
+		if s.seq == seg.seq {
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			c.grow(1)
+			return true
+		}
+		if before(seg.seq, s.seq) {
+			break
+		}
+		s.fastack++
+	}
+	return false
+}
+
+// updateRtt updates rto by Jacobson/Karels algorithm
+func (c *Conn) updateRtt(rtt int64) {
+	if rtt < 0 {
+		return
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+max(interval.Milliseconds(), 4*c.rttvar), minRto), maxRto)
+}
+
+// grow grows congestion window on acked segments, slow start below
+// ssthresh and congestion avoidance above
+func (c *Conn) grow(n int) {
+	for range n {
+		if c.cwnd < c.ssthresh {
+			c.cwnd++
+		} else {
+			c.cwnd += 1 / c.cwnd
+		}
+	}
+	c.cwnd = min(c.cwnd, float64(c.cfg.sendWindow()))
+}
+
+func (c *Conn) recvWindow() uint16 {
+	used := len(c.rcvBuf) + (c.rcvQueue.Len()+mss-1)/mss
+	if used >= rcvWnd {
+		return 0
+	}
+	return uint16(rcvWnd - used)
+}
+
+func (c *Conn) flush() {
+	c.mu.Lock()
+	now := c.now()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	if time.Since(c.lastRecv) > c.cfg.idleTimeout() {
+		c.mu.Unlock()
+		c.terminate(errIdleTimeout)
+		return
+	}
+	var packets [][]byte
+	buf := make([]byte, 0, mtu)
+	wnd := c.recvWindow()
+	output := func(seg *segment) {
+		seg.conv = c.conv
+		seg.wnd = wnd
+		seg.una = c.rcvNxt
+		if len(buf)+headerSize+len(seg.data) > mtu {
+			packets = append(packets, buf)
+			buf = make([]byte, 0, mtu)
+		}
+		buf = seg.encode(buf)
+	}
+
+	for _, ack := range c.acks {
+		ack.cmd = cmdAck
+		output(ack)
+	}
+	c.acks = c.acks[:0]
+
+	limit := min(int(c.cwnd), c.cfg.sendWindow(), int(c.rmtWnd))
+	if limit == 0 && len(c.sndBuf) == 0 {
+		// zero window probe
+		limit = 1
+	}
+	for len(c.sndQueue) > 0 && len(c.sndBuf) < limit {
+		c.sndBuf = append(c.sndBuf, &segment{
+			cmd:  cmdPush,
+			seq:  c.sndNxt,
+			data: c.sndQueue[0],
+		})
+		c.sndQueue = c.sndQueue[1:]
+		c.sndNxt++
+	}
+	if len(c.sndQueue) == 0 {
+		c.sndQueue = nil
+	}
+
+	var lost, fast bool
+	for _, seg := range c.sndBuf {
+		var send bool
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = c.rto
+		case now >= seg.resendAt:
+			send = true
+			lost = true
+			seg.rto = min(seg.rto+seg.rto/2, maxRto)
+		case seg.fastack >= fastResend:
+			send = true
+			fast = true
+			seg.fastack = 0
+		}
+		if !send {
+			continue
+		}
+		seg.xmit++
+		if seg.xmit > deadLink {
+			c.mu.Unlock()
+			c.terminate(errDeadLink)
+			return
+		}
+		seg.ts = uint32(now)
+		seg.resendAt = now + seg.rto
+		output(seg)
+	}
+	if lost {
+		c.ssthresh = max(c.cwnd/2, 2)
+		c.cwnd = 1
+	} else if fast {
+		c.ssthresh = max(float64(len(c.sndBuf))/2, 2)
+		c.cwnd = c.ssthresh
+	}
+
+	var finished bool
+	if c.closing {
+		drained := len(c.sndQueue) == 0 && len(c.sndBuf) == 0
+		if drained || c.remoteClosed || time.Since(c.closingAt) > lingerTime {
+			finished = true
+		}
+	}
+	if len(buf) > 0 {
+		packets = append(packets, buf)
+	}
+	if finished {
+		// close segments are not acked, send them in separate packets
+		for range closeRepeat {
+			packets = append(packets, (&segment{
+				conv: c.conv,
+				cmd:  cmdClose,
+				una:  c.rcvNxt,
+			}).encode(nil))
+		}
+	}
+	c.mu.Unlock()
+
+	for _, pkt := range packets {
+		if c.cfg.Drop != nil && c.cfg.Drop(pkt) {
+			continue
+		}
+		c.pc.WriteTo(pkt, c.remote)
+	}
+	if finished {
+		c.terminate(net.ErrClosed)
+	}
+}
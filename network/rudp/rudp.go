@@ -0,0 +1,202 @@
+// Package rudp implements a reliable udp transport with retransmission,
+// congestion control and ordering, its connections are byte streams and
+// can be used by network.New in place of tcp connections.
+//
+// There is no handshake, the listener creates a connection when the first
+// segment of a conversation arrives from a remote address, the packets of
+// a closed conversation are dropped until the remote gives up.
+package rudp
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dial dial reliable udp connection
+func Dial(addr string) (net.Conn, error) {
+	return DialWithConfig(addr, Config{})
+}
+
+// DialWithConfig dial reliable udp connection with config
+func DialWithConfig(addr string, cfg Config) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConn(rand.Uint32(), pc, raddr, cfg, func() {
+		pc.Close()
+	})
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				conn.terminate(err)
+				return
+			}
+			if from.String() != raddr.String() {
+				continue
+			}
+			conn.input(buf[:n])
+		}
+	}()
+	return conn, nil
+}
+
+// Listener reliable udp listener
+type Listener struct {
+	pc    net.PacketConn
+	cfg   Config
+	mu    sync.Mutex
+	conns map[string]*Conn
+	// removed expire time of the closed conversations, their late
+	// retransmits must not create new connections
+	removed map[string]time.Time
+	closed  bool
+	ch      chan *Conn
+	done    chan struct{}
+}
+
+// Listen listen on udp address
+func Listen(addr string) (*Listener, error) {
+	return ListenWithConfig(addr, Config{})
+}
+
+// ListenWithConfig listen on udp address with config
+func ListenWithConfig(addr string, cfg Config) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		pc:      pc,
+		cfg:     cfg,
+		conns:   make(map[string]*Conn),
+		removed: make(map[string]time.Time),
+		ch:      make(chan *Conn, 128),
+		done:    make(chan struct{}),
+	}
+	go l.loopRead()
+	return l, nil
+}
+
+// Accept accept connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stop accepting, the socket is closed after all accepted
+// connections are closed
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	if len(l.conns) == 0 {
+		return l.pc.Close()
+	}
+	return nil
+}
+
+// Addr returns listener address
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *Listener) loopRead() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			conns := make([]*Conn, 0, len(l.conns))
+			for _, conn := range l.conns {
+				conns = append(conns, conn)
+			}
+			l.mu.Unlock()
+			for _, conn := range conns {
+				conn.terminate(err)
+			}
+			return
+		}
+		if n < headerSize {
+			continue
+		}
+		conv := binary.BigEndian.Uint32(buf)
+		key := from.String() + "/" + strconv.FormatUint(uint64(conv), 10)
+		var rejected *Conn
+		l.mu.Lock()
+		conn := l.conns[key]
+		if conn == nil && !l.closed && l.isNew(key, buf) {
+			conn = newConn(conv, l.pc, from, l.cfg, func() {
+				l.remove(key)
+			})
+			select {
+			case l.ch <- conn:
+				l.conns[key] = conn
+			default:
+				// backlog full, the remote will retransmit
+				rejected, conn = conn, nil
+			}
+		}
+		l.mu.Unlock()
+		if rejected != nil {
+			// terminate calls remove which locks l.mu
+			rejected.terminate(net.ErrClosed)
+		}
+		if conn != nil {
+			conn.input(buf[:n])
+		}
+	}
+}
+
+// isNew returns true when the packet opens a new conversation, it must
+// begin with the first push segment, l.mu must be held
+func (l *Listener) isNew(key string, buf []byte) bool {
+	if buf[4] != cmdPush || binary.BigEndian.Uint32(buf[11:]) != 0 {
+		return false
+	}
+	if expire, ok := l.removed[key]; ok {
+		if time.Now().Before(expire) {
+			return false
+		}
+		delete(l.removed, key)
+	}
+	return true
+}
+
+func (l *Listener) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, expire := range l.removed {
+		if now.After(expire) {
+			delete(l.removed, k)
+		}
+	}
+	// the connections rejected by a full backlog are not in conns, the
+	// remote may retransmit to them
+	if _, ok := l.conns[key]; ok {
+		l.removed[key] = now.Add(l.cfg.idleTimeout())
+	}
+	delete(l.conns, key)
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
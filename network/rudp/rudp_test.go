@@ -0,0 +1,242 @@
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+func lossy(rate float64) func([]byte) bool {
+	return func([]byte) bool {
+		return mrand.Float64() < rate
+	}
+}
+
+func transfer(t *testing.T, cfg Config, size int) {
+	l, err := ListenWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialWithConfig(l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestEcho(t *testing.T) {
+	transfer(t, Config{}, 1<<20)
+}
+
+func TestPacketLoss(t *testing.T) {
+	transfer(t, Config{Drop: lossy(0.2)}, 256<<10)
+}
+
+func TestRemoteClose(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+}
+
+func TestBacklogFull(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	// open more connections than the backlog without accepting them
+	for conv := uint32(1); conv <= uint32(cap(l.ch))+8; conv++ {
+		seg := segment{conv: conv, cmd: cmdPush, data: []byte("hi")}
+		if _, err := pc.WriteTo(seg.encode(nil), l.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the listener still serves the new connections
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cap(l.ch); i++ {
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	const (
+		writers = 4
+		frames  = 5
+		size    = 16 << 10
+	)
+	cfg := Config{SendWindow: 4}
+	l, err := ListenWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := DialWithConfig(l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// every frame is larger than the send window, Write waits in the
+	// middle of it
+	for i := range writers {
+		go func() {
+			frame := bytes.Repeat([]byte{byte(i)}, size)
+			for range frames {
+				if _, err := conn.Write(frame); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(30 * time.Second))
+	frame := make([]byte, size)
+	for range writers * frames {
+		if _, err := io.ReadFull(accepted, frame); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(frame, frame[:1]) != size {
+			t.Fatal("interleaved frame")
+		}
+	}
+}
+
+func TestStalePush(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	first := segment{conv: 1, cmd: cmdPush, data: []byte("hi")}
+	if _, err := pc.WriteTo(first.encode(nil), l.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	for i := 0; ; i++ {
+		l.mu.Lock()
+		n := len(l.conns)
+		l.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("closed connection still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// late retransmits of the closed conversation and a push from the
+	// middle of an unknown one
+	for _, seg := range []segment{
+		first,
+		{conv: 1, cmd: cmdPush, seq: 1, data: []byte("again")},
+		{conv: 2, cmd: cmdPush, seq: 5, data: []byte("late")},
+	} {
+		if _, err := pc.WriteTo(seg.encode(nil), l.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case conn := <-l.ch:
+		t.Fatalf("stale push accepted from %s", conn.RemoteAddr())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
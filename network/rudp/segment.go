@@ -0,0 +1,74 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortSegment = errors.New("rudp: short segment")
+
+const (
+	cmdPush  = 1 // 数据
+	cmdAck   = 2 // 确认
+	cmdClose = 3 // 关闭
+)
+
+// 分片格式，一个udp数据包中可包含多个分片
+// +---------+--------+--------+-------+--------+--------+--------+---------+
+// | Conv(4) | Cmd(1) | Wnd(2) | Ts(4) | Seq(4) | Una(4) | Len(2) | Payload |
+// +---------+--------+--------+-------+--------+--------+--------+---------+
+// Conv为连接标识，Wnd为发送方剩余接收窗口，Una为发送方下一个期望接收的序号，
+// 在Ack分片中Ts字段为被确认分片的发送时间，用于计算rtt
+const headerSize = 21
+
+type segment struct {
+	conv uint32
+	cmd  byte
+	wnd  uint16
+	ts   uint32
+	seq  uint32
+	una  uint32
+	data []byte
+	// sender side state
+	xmit     int
+	resendAt int64
+	rto      int64
+	fastack  int
+}
+
+func (s *segment) encode(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, s.conv)
+	buf = append(buf, s.cmd)
+	buf = binary.BigEndian.AppendUint16(buf, s.wnd)
+	buf = binary.BigEndian.AppendUint32(buf, s.ts)
+	buf = binary.BigEndian.AppendUint32(buf, s.seq)
+	buf = binary.BigEndian.AppendUint32(buf, s.una)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s.data)))
+	return append(buf, s.data...)
+}
+
+func decode(data []byte) (*segment, []byte, error) {
+	if len(data) < headerSize {
+		return nil, nil, errShortSegment
+	}
+	s := &segment{
+		conv: binary.BigEndian.Uint32(data),
+		cmd:  data[4],
+		wnd:  binary.BigEndian.Uint16(data[5:]),
+		ts:   binary.BigEndian.Uint32(data[7:]),
+		seq:  binary.BigEndian.Uint32(data[11:]),
+		una:  binary.BigEndian.Uint32(data[15:]),
+	}
+	size := int(binary.BigEndian.Uint16(data[19:]))
+	data = data[headerSize:]
+	if len(data) < size {
+		return nil, nil, errShortSegment
+	}
+	s.data = data[:size]
+	return s, data[size:], nil
+}
+
+// before returns true when sequence a is before b with wrap around
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"math"
+	"sync"
 	"sync/atomic"
 )
 
@@ -17,19 +18,22 @@ var ErrClosedByRemote = errors.New("network: closed by remote")
 type Stream struct {
 	parent *Conn
 	id     uint32
+	opened bool // opened by this side
 	closed atomic.Bool
 	chRead chan []byte
 	// runtime
 	err    error
+	mErr   sync.Mutex
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func newStream(parent *Conn, id uint32) *Stream {
+func newStream(parent *Conn, id uint32, opened bool) *Stream {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Stream{
 		parent: parent,
 		id:     id & 0xffffff,
+		opened: opened,
 		chRead: make(chan []byte, 1000),
 		ctx:    ctx,
 		cancel: cancel,
@@ -41,6 +45,28 @@ func (s *Stream) ID() uint32 {
 	return s.id & 0xffffff
 }
 
+// key returns the key in Conn.streams
+func (s *Stream) key() uint32 {
+	if s.opened {
+		return s.ID() | openedKey
+	}
+	return s.ID()
+}
+
+// flag returns the stream id with the opener flag for sending
+func (s *Stream) flag() uint32 {
+	if s.opened {
+		return s.ID() | flagStreamOpener
+	}
+	return s.ID()
+}
+
+// Context returns a context that is done when the stream is closed by
+// either side
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
 // Close close stream
 func (s *Stream) Close() error {
 	s.onClose(nil)
@@ -49,19 +75,32 @@ func (s *Stream) Close() error {
 
 func (s *Stream) onClose(err error) {
 	s.closed.Store(true)
-	s.err = err
+	s.mErr.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mErr.Unlock()
 	s.cancel()
-	s.parent.chWriteControl <- writeControlArgs{
-		id:   s.ID(),
-		flag: flagStreamClose,
+	// 通过数据通道发送close，保证其在该stream已写入的数据之后
+	s.parent.chWrite <- writeArgs{
+		flag: s.flag() | flagStreamClose,
 	}
 	s.parent.mStreams.Lock()
-	delete(s.parent.streams, s.ID())
+	delete(s.parent.streams, s.key())
 	s.parent.mStreams.Unlock()
 }
 
 // Read read data
 func (s *Stream) Read(p []byte) (int, error) {
+	// data received before closed by remote is still readable
+	select {
+	case data := <-s.chRead:
+		if len(data) > len(p) {
+			return 0, errBufferTooShort
+		}
+		return copy(p, data), nil
+	default:
+	}
 	if s.closed.Load() {
 		return 0, ErrStreamClosed
 	}
@@ -72,6 +111,11 @@ func (s *Stream) Read(p []byte) (int, error) {
 		}
 		return copy(p, data), nil
 	case <-s.ctx.Done():
+		s.mErr.Lock()
+		defer s.mErr.Unlock()
+		if s.err == nil {
+			return 0, ErrStreamClosed
+		}
 		return 0, s.err
 	}
 }
@@ -87,29 +131,30 @@ func (s *Stream) Write(p []byte) (int, error) {
 	data := make([]byte, len(p))
 	copy(data, p)
 	s.parent.chWrite <- writeArgs{
-		flag: s.ID() | flagStreamData,
+		flag: s.flag() | flagStreamData,
 		data: data,
 	}
 	return len(p), nil
 }
 
 func (c *Conn) handleOpenStream() error {
-	stream := newStream(c, c.streamID.Add(1))
+	stream := newStream(c, c.streamID.Add(1), false)
+	// register before the ack, the opener may send data right after it
+	c.mStreams.Lock()
+	c.streams[stream.key()] = stream
+	c.mStreams.Unlock()
 	c.chWriteControl <- writeControlArgs{
 		id:   stream.id,
 		flag: flagStreamOpenAck,
 	}
-	c.mStreams.Lock()
-	c.streams[stream.id] = stream
-	c.mStreams.Unlock()
-	c.chStreamOpened <- stream
+	c.chStreamAccepted <- stream
 	return nil
 }
 
 func (c *Conn) handleOpenStreamAck(flag uint32) error {
-	s := newStream(c, flag)
+	s := newStream(c, flag, true)
 	c.mStreams.Lock()
-	c.streams[s.id] = s
+	c.streams[s.key()] = s
 	c.mStreams.Unlock()
 	c.chStreamOpened <- s
 	return nil
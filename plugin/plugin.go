@@ -0,0 +1,306 @@
+// Package plugin runs crpc over the stdin and stdout of a subprocess.
+//
+// The host starts the plugin binary with Start and calls it through the
+// returned client, the plugin calls Serve in its main function and may
+// call the host callbacks through the client returned by Serve. A plugin
+// that exits or crashes is restarted on the next reconnect of the client.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lwch/crpc"
+	"github.com/lwch/crpc/encoding"
+	"github.com/lwch/crpc/network"
+	"github.com/lwch/logging"
+)
+
+// Version plugin protocol version
+const Version = 1
+
+const (
+	envMagic       = "CRPC_PLUGIN_MAGIC"
+	magic          = "5f2e8a0c6b7d4e19"
+	handshakeName  = "crpc-plugin"
+	startTimeout   = 10 * time.Second
+	stopTimeout    = 3 * time.Second
+	restartBackoff = time.Second
+)
+
+var errNotPlugin = errors.New("plugin: not launched by a crpc host")
+var errHandshake = errors.New("plugin: invalid handshake")
+
+// Config plugin config
+type Config struct {
+	// Path plugin binary
+	Path string
+	Args []string
+	// Env extra environment variables in key=value form
+	Env        []string
+	Encrypter  encoding.Encrypter
+	Compresser encoding.Compresser
+	Codec      encoding.Codec
+	// OnRequest serves the host callbacks called by the plugin
+	OnRequest crpc.RequestHandlerFunc
+	// OnAccept serves the streams opened by the plugin
+	OnAccept crpc.AcceptStreamHandlerFunc
+}
+
+// Plugin running plugin
+type Plugin struct {
+	cfg       Config
+	cli       *crpc.Client
+	mu        sync.Mutex
+	proc      *process
+	lastStart time.Time
+	restarts  int
+	closed    bool
+}
+
+// Start start the plugin process and connect to it
+func Start(cfg Config) (*Plugin, error) {
+	p := &Plugin{cfg: cfg}
+	cli, err := crpc.NewClientWithConfig(cfg.Path, crpc.ClientConfig{
+		Encrypter:  cfg.Encrypter,
+		Compresser: cfg.Compresser,
+		Codec:      cfg.Codec,
+		Dial:       p.dial,
+		OnRequest:  cfg.OnRequest,
+		OnAccept:   cfg.OnAccept,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.cli = cli
+	return p, nil
+}
+
+// Client returns the client for calling the plugin
+func (p *Plugin) Client() *crpc.Client {
+	return p.cli
+}
+
+// Restarts returns how many times the plugin was restarted
+func (p *Plugin) Restarts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts
+}
+
+// Close close the client and stop the plugin process
+func (p *Plugin) Close() error {
+	err := p.cli.Close()
+	p.mu.Lock()
+	p.closed = true
+	proc := p.proc
+	p.mu.Unlock()
+	if proc != nil {
+		proc.Close()
+	}
+	return err
+}
+
+func (p *Plugin) dial(ctx context.Context, _ string) (net.Conn, error) {
+	p.mu.Lock()
+	lastStart := p.lastStart
+	p.mu.Unlock()
+	if !lastStart.IsZero() {
+		// avoid restarting a crashing plugin in a busy loop, the lock is
+		// not held while waiting so that Close is not blocked
+		if d := restartBackoff - time.Since(lastStart); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		logging.Info("plugin: restart %s", p.cfg.Path)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, crpc.ErrClosed
+	}
+	if !lastStart.IsZero() {
+		p.restarts++
+	}
+	p.lastStart = time.Now()
+	p.mu.Unlock()
+	// Close is not blocked by the handshake, the process started after it
+	// is killed below
+	proc, err := start(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		proc.kill()
+		return nil, crpc.ErrClosed
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+type process struct {
+	net.Conn
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func start(cfg Config) (*process, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(cfg.Path, cfg.Args...)
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	cmd.Env = append(cmd.Env, envMagic+"="+magic)
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	// the child ends are owned by the plugin now
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+	proc := &process{
+		Conn:   network.NewPipe(stdoutR, stdinW, "plugin:"+cfg.Path),
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			logging.Error("plugin %s exited: %v", cfg.Path, err)
+		}
+		close(proc.exited)
+	}()
+	if err := handshake(stdoutR); err != nil {
+		proc.Close()
+		return nil, err
+	}
+	return proc, nil
+}
+
+// handshake reads the handshake line without buffering ahead of it
+func handshake(f *os.File) error {
+	f.SetReadDeadline(time.Now().Add(startTimeout))
+	defer f.SetReadDeadline(time.Time{})
+	var line []byte
+	var b [1]byte
+	for {
+		if _, err := f.Read(b[:]); err != nil {
+			return fmt.Errorf("plugin: read handshake: %v", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) > 64 {
+			return errHandshake
+		}
+	}
+	name, version, ok := strings.Cut(string(line), "|")
+	if !ok || name != handshakeName {
+		return errHandshake
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return errHandshake
+	}
+	if v != Version {
+		return fmt.Errorf("plugin: unsupported protocol version %d", v)
+	}
+	return nil
+}
+
+// Close close the pipes and wait for the process, the process is killed
+// if it does not exit in time
+func (proc *process) Close() error {
+	err := proc.Conn.Close()
+	select {
+	case <-proc.exited:
+	case <-time.After(stopTimeout):
+		proc.cmd.Process.Kill()
+		<-proc.exited
+	}
+	return err
+}
+
+// kill kill the process and wait for it
+func (proc *process) kill() {
+	proc.Conn.Close()
+	proc.cmd.Process.Kill()
+	<-proc.exited
+}
+
+// ServeConfig plugin side config
+type ServeConfig struct {
+	Encrypter  encoding.Encrypter
+	Compresser encoding.Compresser
+	Codec      encoding.Codec
+	// OnRequest serves the calls from host
+	OnRequest crpc.RequestHandlerFunc
+	// OnAccept serves the streams opened by host
+	OnAccept crpc.AcceptStreamHandlerFunc
+}
+
+// Serve serves the host over stdin and stdout, the returned client calls
+// the host callbacks and is closed when the host goes away. os.Stdout and
+// the standard logger are redirected to stderr since stdout carries the
+// protocol.
+func Serve(cfg ServeConfig) (*crpc.Client, error) {
+	if os.Getenv(envMagic) != magic {
+		return nil, errNotPlugin
+	}
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	log.SetOutput(os.Stderr)
+	w := bufio.NewWriter(stdout)
+	fmt.Fprintf(w, "%s|%d\n", handshakeName, Version)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	conn := network.NewPipe(os.Stdin, stdout, "host")
+	return crpc.NewClientWithConfig("host", crpc.ClientConfig{
+		Encrypter:  cfg.Encrypter,
+		Compresser: cfg.Compresser,
+		Codec:      cfg.Codec,
+		Dial: func(context.Context, string) (net.Conn, error) {
+			var c net.Conn
+			once.Do(func() {
+				c = conn
+			})
+			if c == nil {
+				// the host owns our lifecycle, never reconnect
+				return nil, crpc.ErrClosed
+			}
+			return c, nil
+		},
+		OnRequest: cfg.OnRequest,
+		OnAccept:  cfg.OnAccept,
+	})
+}
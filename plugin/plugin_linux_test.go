@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCloseDuringRestart(t *testing.T) {
+	if os.Getenv(envMagic) == magic {
+		servePlugin(t)
+		return
+	}
+	pids := filepath.Join(t.TempDir(), "pids")
+	p := startPlugin(t, envPids+"="+pids)
+	p.mu.Lock()
+	p.proc.cmd.Process.Kill()
+	p.mu.Unlock()
+	// close while the new process is being started
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Restarts() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin not restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Close()
+	// every process is killed and waited, signal 0 succeeds on zombies
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(pids)
+		lines := strings.Fields(string(data))
+		alive := 0
+		for _, line := range lines {
+			pid, _ := strconv.Atoi(line)
+			if syscall.Kill(pid, 0) == nil {
+				alive++
+			}
+		}
+		if len(lines) == 2 && alive == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("plugin process leaked")
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc"
+)
+
+func reply(body string) crpc.RequestHandlerFunc {
+	return func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+}
+
+func call(cli *crpc.Client) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://plugin/ping", nil)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rep, err := cli.Call(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(rep.Body)
+	return string(data), err
+}
+
+// envPids file the plugin processes append their pids to
+const envPids = "CRPC_TEST_PIDS"
+
+// servePlugin runs the test binary as the plugin, it replies with the
+// result of the host callback
+func servePlugin(t *testing.T) {
+	if name := os.Getenv(envPids); len(name) > 0 {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(f, os.Getpid())
+		f.Close()
+	}
+	ready := make(chan *crpc.Client, 1)
+	host, err := Serve(ServeConfig{
+		OnRequest: func(*http.Request) (*http.Response, error) {
+			host := <-ready
+			ready <- host
+			got, err := call(host)
+			if err != nil {
+				return nil, err
+			}
+			return reply("plugin:" + got)(nil)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready <- host
+	<-host.Done()
+}
+
+func startPlugin(t *testing.T, env ...string) *Plugin {
+	p, err := Start(Config{
+		Path:      os.Args[0],
+		Args:      []string{"-test.run=^" + t.Name() + "$"},
+		Env:       env,
+		OnRequest: reply("host"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPlugin(t *testing.T) {
+	if os.Getenv(envMagic) == magic {
+		servePlugin(t)
+		return
+	}
+	p := startPlugin(t)
+	defer p.Close()
+	if got, err := call(p.Client()); err != nil || got != "plugin:host" {
+		t.Fatalf("call plugin: %q, %v", got, err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	if os.Getenv(envMagic) == magic {
+		servePlugin(t)
+		return
+	}
+	p := startPlugin(t)
+	defer p.Close()
+	p.mu.Lock()
+	p.proc.cmd.Process.Kill()
+	p.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got, err := call(p.Client())
+		if err == nil && got == "plugin:host" {
+			if p.Restarts() != 1 {
+				t.Fatalf("unexpected restarts: %d", p.Restarts())
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("plugin not restarted")
+}
+
+func TestCloseDuringBackoff(t *testing.T) {
+	if os.Getenv(envMagic) == magic {
+		servePlugin(t)
+		return
+	}
+	p := startPlugin(t)
+	p.mu.Lock()
+	p.proc.cmd.Process.Kill()
+	p.mu.Unlock()
+	// let the client wait for the restart backoff
+	time.Sleep(100 * time.Millisecond)
+	begin := time.Now()
+	p.Close()
+	if d := time.Since(begin); d > restartBackoff/2 {
+		t.Fatalf("close blocked by the restart backoff: %v", d)
+	}
+}
+
+func TestNotPlugin(t *testing.T) {
+	if os.Getenv(envMagic) == magic {
+		return
+	}
+	if _, err := Serve(ServeConfig{}); err != errNotPlugin {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package crpc
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/lwch/logging"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// Policy authorization policy of requests and streams, a request or
+// stream is allowed when any rule matches, otherwise it is denied
+type Policy struct {
+	Rules []Rule
+	// Roles returns the roles of the identity returned by
+	// ServerConfig.Authenticate. When nil, a string identity is its own
+	// role, a []string identity is the list of roles and an identity
+	// implementing Roles() []string returns its roles.
+	Roles func(identity any) []string
+}
+
+// Rule authorization rule
+type Rule struct {
+	// Roles the rule applies to, "*" matches every caller including the
+	// anonymous ones
+	Roles []string
+	// Methods allowed http methods, empty means all methods
+	Methods []string
+	// Paths allowed path patterns in path.Match syntax, a pattern ending
+	// with "/**" matches everything under the prefix
+	Paths []string
+	// Streams allowed stream name patterns in path.Match syntax
+	Streams []string
+}
+
+func (p *Policy) roles(identity any) []string {
+	if p.Roles != nil {
+		return p.Roles(identity)
+	}
+	switch v := identity.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case interface{ Roles() []string }:
+		return v.Roles()
+	}
+	return nil
+}
+
+func (r *Rule) applies(roles []string) bool {
+	for _, role := range r.Roles {
+		if role == "*" || slices.Contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+			if name == prefix || strings.HasPrefix(name, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical reports whether p is not changed by path.Clean except for a
+// trailing slash, e.g. /public/../admin could escape /public/**
+func canonical(p string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p
+}
+
+// AllowRequest reports whether the identity may call the method on path,
+// paths containing "." or ".." elements or empty elements are denied
+func (p *Policy) AllowRequest(identity any, method, path string) bool {
+	if !canonical(path) {
+		return false
+	}
+	roles := p.roles(identity)
+	for _, rule := range p.Rules {
+		if !rule.applies(roles) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, method) {
+			continue
+		}
+		if match(rule.Paths, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowStream reports whether the identity may open the stream with name
+func (p *Policy) AllowStream(identity any, name string) bool {
+	roles := p.roles(identity)
+	for _, rule := range p.Rules {
+		if rule.applies(roles) && match(rule.Streams, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize wraps the handler, denied requests are answered with 403
+func (p *Policy) authorize(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		identity := IdentityFromContext(r.Context())
+		if !p.AllowRequest(identity, r.Method, r.URL.Path) {
+			logging.Info("policy: deny %s %s for %v from %s", r.Method, r.URL.Path, identity, r.RemoteAddr)
+			return &http.Response{
+				StatusCode: http.StatusForbidden,
+				Body:       io.NopCloser(strings.NewReader(errForbidden.Error())),
+			}, nil
+		}
+		return next(r)
+	}
+}
@@ -0,0 +1,107 @@
+package crpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		Authenticate: func(info AuthInfo) (any, error) {
+			return string(info.Credential), nil
+		},
+		Policy: &Policy{Rules: []Rule{
+			{Roles: []string{"*"}, Methods: []string{http.MethodGet}, Paths: []string{"/public/**"}},
+			{Roles: []string{"admin"}, Paths: []string{"/**"}, Streams: []string{"*"}},
+			{Roles: []string{"user"}, Streams: []string{"chat.*"}},
+		}},
+		OnRequest: reply("ok"),
+		OnAccept: func(s *Stream) {
+			s.Close()
+		},
+		NamedStreams: true,
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Credentials:  TokenCredentials("user"),
+		NamedStreams: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	status := func(path string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		rep, err := cli.Call(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep.StatusCode
+	}
+	if code := status("/public/ping"); code != http.StatusOK {
+		t.Fatalf("public path: %d", code)
+	}
+	for _, path := range []string{"/admin/ping", "/public/../admin/ping", "/public/./x/.."} {
+		if code := status(path); code != http.StatusForbidden {
+			t.Fatalf("%s: %d", path, code)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := cli.OpenNamedStream(ctx, "chat.room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	_, err = cli.OpenNamedStream(ctx, "admin.console")
+	if !errors.Is(err, ErrStreamRefused) {
+		t.Fatalf("stream not refused: %v", err)
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	p := &Policy{Rules: []Rule{
+		{Roles: []string{"*"}, Paths: []string{"/public/**"}},
+	}}
+	for _, c := range []struct {
+		path  string
+		allow bool
+	}{
+		{"/public", true},
+		{"/public/", true},
+		{"/public/a/b", true},
+		{"/public/a/", true},
+		{"/publicity", false},
+		{"/public/../admin", false},
+		{"/public/a/..", false},
+		{"/public//a", false},
+		{"/public/.", false},
+	} {
+		if got := p.AllowRequest(nil, http.MethodGet, c.path); got != c.allow {
+			t.Errorf("AllowRequest(%q) = %v", c.path, got)
+		}
+	}
+}
+
+func TestNamedStreamsDisabled(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{OnAccept: echo})
+	cli, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cli.OpenNamedStream(ctx, "chat.room"); err != errNamedStreams {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the first message is data rather than the name
+	s, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ping(t, s, "hello")
+}
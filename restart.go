@@ -0,0 +1,17 @@
+//go:build !linux
+
+package crpc
+
+import "net"
+
+// InheritedListener returns the listener passed by a restarting parent
+// process, restarting is only supported on linux
+func InheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+// InheritedListeners returns the listeners passed by a restarting parent
+// process, restarting is only supported on linux
+func InheritedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package crpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// comma separated, a single fd is compatible with the parents
+	// passing one listener
+	envListenFD = "CRPC_LISTEN_FD"
+	envReadyFD  = "CRPC_READY_FD"
+)
+
+var errListenerFile = errors.New("restart: listener has no file descriptor")
+var errNoListener = errors.New("restart: server is not listening")
+
+// InheritedListener returns the listener passed by a restarting parent
+// process and tells the parent that the child is ready, it returns nil
+// when the process was not started by Restart, see InheritedListeners for
+// the parents listening with several acceptors
+func InheritedListener() (net.Listener, error) {
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) == 0 {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, fmt.Errorf("restart: %d listeners inherited", len(listeners))
+	}
+	return listeners[0], nil
+}
+
+// InheritedListeners returns the listeners passed by a restarting parent
+// process and tells the parent that the child is ready, it returns nil
+// when the process was not started by Restart
+func InheritedListeners() ([]net.Listener, error) {
+	str := os.Getenv(envListenFD)
+	if len(str) == 0 {
+		return nil, nil
+	}
+	ready := os.Getenv(envReadyFD)
+	// do not leak to the grandchildren
+	os.Unsetenv(envListenFD)
+	os.Unsetenv(envReadyFD)
+	var listeners []net.Listener
+	for _, str := range strings.Split(str, ",") {
+		fd, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("restart: invalid %s: %s", envListenFD, str)
+		}
+		f := os.NewFile(uintptr(fd), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("restart: inherit listener: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+	if fd, err := strconv.Atoi(ready); err == nil {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+	return listeners, nil
+}
+
+// Restart re-executes the current binary with the same arguments, see
+// RestartCommand
+func (svr *Server) Restart(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return svr.RestartCommand(ctx, cmd)
+}
+
+// RestartCommand starts cmd with the listening sockets inherited, the
+// child picks them up by ListenAndServe or InheritedListeners. Once the
+// child is ready this server stops accepting and shuts down gracefully, if
+// the child fails to start this server keeps serving.
+func (svr *Server) RestartCommand(ctx context.Context, cmd *exec.Cmd) error {
+	svr.mu.Lock()
+	listeners := svr.listeners
+	svr.mu.Unlock()
+	if len(listeners) == 0 {
+		return errNoListener
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	var fds []string
+	for _, l := range listeners {
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errListenerFile
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		fds = append(fds, strconv.Itoa(fd))
+		fd++
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%s=%s", envListenFD, strings.Join(fds, ",")),
+		fmt.Sprintf("%s=%d", envReadyFD, fd))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("restart: child is not ready: %v", err)
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return ctx.Err()
+	}
+	return svr.Shutdown(ctx)
+}
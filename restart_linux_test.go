@@ -0,0 +1,63 @@
+//go:build linux
+
+package crpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const envRestartChild = "CRPC_TEST_RESTART_CHILD"
+
+func TestRestart(t *testing.T) {
+	if os.Getenv(envRestartChild) != "" {
+		l, err := InheritedListener()
+		if err != nil || l == nil {
+			t.Fatalf("inherit listener: %v", err)
+		}
+		svr := NewServer(ServerConfig{OnRequest: reply("child")})
+		time.AfterFunc(5*time.Second, func() {
+			svr.Close()
+		})
+		svr.Serve(l)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(ServerConfig{OnRequest: reply("parent")})
+	go svr.Serve(l)
+	cli, err := NewClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if got, err := call(cli); err != nil || got != "parent" {
+		t.Fatalf("call parent: %q, %v", got, err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestart$")
+	cmd.Env = append(os.Environ(), envRestartChild+"=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.RestartCommand(ctx, cmd); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	deadline := time.Now().Add(4 * time.Second)
+	for time.Now().Before(deadline) {
+		got, err := call(cli)
+		if err == nil && got == "child" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("client did not reach the child process")
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package crpc
+
+import (
+	"net"
+
+	"github.com/lwch/logging"
+)
+
+func listen(addr string, n int) ([]net.Listener, error) {
+	if n > 1 {
+		logging.Warning("SO_REUSEPORT is only supported on linux, use one listener")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
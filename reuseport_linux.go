@@ -0,0 +1,47 @@
+//go:build linux
+
+package crpc
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func listen(addr string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		},
+	}
+	listeners := make([]net.Listener, 0, n)
+	for range n {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		// a random port is only chosen once
+		addr = l.Addr().String()
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
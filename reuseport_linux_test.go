@@ -0,0 +1,51 @@
+//go:build linux
+
+package crpc
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReusePort(t *testing.T) {
+	listeners, err := listen("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("unexpected listeners: %d", len(listeners))
+	}
+	svr := NewServer(ServerConfig{OnRequest: reply("pong")})
+	defer svr.Close()
+	addr := listeners[0].Addr().String()
+	for _, l := range listeners {
+		if l.Addr().String() != addr {
+			t.Fatalf("listening on %s and %s", addr, l.Addr())
+		}
+		raw, err := l.(*net.TCPListener).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opt int
+		raw.Control(func(fd uintptr) {
+			opt, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT)
+		})
+		if err != nil || opt != 1 {
+			t.Fatalf("SO_REUSEPORT not set: %d, %v", opt, err)
+		}
+		go svr.Serve(l)
+	}
+	for range 8 {
+		cli, err := NewClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := call(cli)
+		cli.Close()
+		if err != nil || got != "pong" {
+			t.Fatalf("call: %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package crpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc/network/rudp"
+)
+
+func TestRUDP(t *testing.T) {
+	// the small window makes the writes wait in the middle of a frame
+	cfg := rudp.Config{
+		Drop: func([]byte) bool {
+			return mrand.Float64() < 0.1
+		},
+		SendWindow: 8,
+	}
+	l, err := rudp.ListenWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(ServerConfig{
+		OnRequest: reply("pong"),
+		OnAccept:  echo,
+	})
+	defer svr.Close()
+	go svr.Serve(l)
+	cli, err := NewClientWithConfig(l.Addr().String(), ClientConfig{
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return rudp.DialWithConfig(addr, cfg)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// keepalives are written by another goroutine than the data
+	cli.RLock()
+	tp := cli.tp
+	cli.RUnlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			tp.conn.SendKeepalive()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	if got, err := call(cli); err != nil || got != "pong" {
+		t.Fatalf("call: %q, %v", got, err)
+	}
+	streamCtx, streamCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer streamCancel()
+	s, err := cli.OpenStream(streamCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// larger than maxWriteSize, it is sent in several messages
+	data := make([]byte, 128<<10)
+	rand.Read(data)
+	go func() {
+		if _, err := s.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data mismatch")
+	}
+}
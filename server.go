@@ -1,9 +1,18 @@
 package crpc
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/lwch/crpc/encoding"
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/encrypt"
+	"github.com/lwch/crpc/network"
+	"github.com/lwch/crpc/network/proxyproto"
 	"github.com/lwch/logging"
 )
 
@@ -12,11 +21,17 @@ type AcceptStreamHandlerFunc func(*Stream)
 
 // Server rpc server
 type Server struct {
-	listener       net.Listener
-	encrypter      encoding.Encrypter
-	compresser     encoding.Compresser
-	onRequest      RequestHandlerFunc
-	onAcceptStream AcceptStreamHandlerFunc
+	mu        sync.Mutex
+	listeners []net.Listener
+	// http servers of HTTPHandler on the listeners
+	httpServers []*http.Server
+	sessions    map[uint64]*Session
+	sessionID   uint64
+	cfg         ServerConfig
+	limiter     *connLimiter
+	// shutdown is set by Shutdown, the connections still in their
+	// handshakes are closed instead of registered
+	shutdown bool
 }
 
 // ServerConfig server config
@@ -25,58 +40,475 @@ type ServerConfig struct {
 	Compresser encoding.Compresser
 	OnRequest  RequestHandlerFunc
 	OnAccept   AcceptStreamHandlerFunc
+	// HTTPHandler serves plain http clients on the same listener,
+	// connections are told apart by their first byte
+	HTTPHandler http.Handler
+	// TrustedProxies enables PROXY protocol v1 and v2 for connections
+	// from the given CIDRs or ips, e.g. tcp load balancers, the address
+	// in the header is used as the remote address of the connection
+	TrustedProxies []string
+	// Acceptors opens the given number of listeners on the same address
+	// with SO_REUSEPORT in ListenAndServe, each with its own accept loop,
+	// so the kernel spreads new connections across them, linux only
+	Acceptors int
+	// KeyExchange runs an x25519 key exchange on every new connection,
+	// the session keys replace Encrypter
+	KeyExchange *encrypt.Exchange
+	// Authenticate verifies the credentials of every new connection, the
+	// returned identity is attached to the contexts of its requests and
+	// streams, see IdentityFromContext
+	Authenticate AuthenticateFunc
+	// Policy restricts the paths and stream names by the identity of the
+	// connection, denied requests are answered with 403 and denied streams
+	// are refused
+	Policy *Policy
+	// NamedStreams sends the name of every opened stream and waits for the
+	// remote side to accept it, so that ErrStreamRefused is returned when
+	// it is refused. Both sides must enable it, see
+	// ClientConfig.NamedStreams, streams have no name when disabled.
+	NamedStreams bool
+	// AllowCIDRs only accepts connections from the given CIDRs or ips when
+	// not empty, DenyCIDRs rejects connections from the given ones
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	// MaxConns limits the number of connections, zero means no limit
+	MaxConns int
+	// MaxConnsPerIP limits the number of connections from each ip, zero
+	// means no limit
+	MaxConnsPerIP int
+	// Limits resource limits of every connection
+	Limits Limits
+	// Codec replaces the default codec, it must support the types of
+	// codec.New, e.g. wrap it, Limits.MaxHeaderBytes and MaxHeaderCount
+	// only apply to the default codec
+	Codec encoding.Codec
+	// CodecConfig config of the default codec, e.g. Resolver and
+	// LegacyProtobuf, the header limits of Limits override it when set
+	CodecConfig codec.Config
+	// OnConnect is called for every new connection after the handshakes,
+	// returning an error rejects the connection, the error is sent to the
+	// client in the auth handshake when Authenticate is set. The non-nil
+	// fields of the returned ConnConfig replace the ones above for this
+	// connection
+	OnConnect func(ConnInfo) (ConnConfig, error)
+	// OnDisconnect is called when a connection accepted by OnConnect is
+	// closed, with the error it is closed with
+	OnDisconnect func(ConnInfo, error)
+}
+
+// ConnInfo information of a new connection
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// Identity returned by ServerConfig.Authenticate
+	Identity    any
+	ConnectedAt time.Time
+}
+
+// ConnConfig per connection config returned by ServerConfig.OnConnect,
+// the peer must use the same Encrypter, Compresser and Codec after the
+// handshakes
+type ConnConfig struct {
+	Encrypter  encoding.Encrypter
+	Compresser encoding.Compresser
+	Codec      encoding.Codec
+	OnRequest  RequestHandlerFunc
+	OnAccept   AcceptStreamHandlerFunc
 }
 
 // NewServer create server
 func NewServer(cfg ServerConfig) *Server {
 	return &Server{
-		encrypter:      cfg.Encrypter,
-		compresser:     cfg.Compresser,
-		onRequest:      cfg.OnRequest,
-		onAcceptStream: cfg.OnAccept,
+		sessions: make(map[uint64]*Session),
+		cfg:      cfg,
+	}
+}
+
+// config returns the current config
+func (svr *Server) config() ServerConfig {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	return svr.cfg
+}
+
+// UpdateConfig replace the config, it takes effect on new connections.
+// Limits and Policy also take effect on the connections already
+// established, the ones denied by the new ip lists are closed, and so
+// does Encrypter for those using it when both the old and new ones are
+// key rings, see encrypt.KeyRing.Update. The connection limits only
+// apply to new connections. TrustedProxies, HTTPHandler and Acceptors
+// only take effect on the listeners served afterwards.
+func (svr *Server) UpdateConfig(cfg ServerConfig) error {
+	// validate before applying anything
+	check, err := newConnLimiter(cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := proxyproto.ParsePrefixes(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	svr.mu.Lock()
+	if svr.limiter != nil {
+		if err := svr.limiter.update(cfg); err != nil {
+			svr.mu.Unlock()
+			return err
+		}
+	}
+	svr.cfg = cfg
+	var denied []*Session
+	for _, sess := range svr.sessions {
+		svr.apply(sess)
+		// check is not shared
+		if check.denied(remoteIP(sess.RemoteAddr())) {
+			denied = append(denied, sess)
+		}
+	}
+	svr.mu.Unlock()
+	// closed without svr.mu, the sessions unregister themselves
+	for _, sess := range denied {
+		logging.Info("kick %s: %v", sess.RemoteAddr(), errDenied)
+		sess.Close()
+	}
+	return nil
+}
+
+// apply apply the live settings of the current config to the session,
+// the caller must hold svr.mu
+func (svr *Server) apply(sess *Session) {
+	sess.tp.SetLimits(svr.cfg.Limits)
+	if sess.keys == nil {
+		return
+	}
+	// compare the rings only, encrypters may not be comparable
+	newRing, ok := svr.cfg.Encrypter.(*encrypt.KeyRing)
+	if ok && newRing == sess.keys {
+		return
 	}
+	ring, ok2 := sess.tp.encrypter.(*encrypt.KeyRing)
+	if !ok || !ok2 {
+		// the connection keeps its keys
+		sess.keys = nil
+		return
+	}
+	ring.Update(newRing)
+	sess.keys = newRing
 }
 
-// ListenAndServe listen and serve
+// ListenAndServe listen and serve, the listeners inherited from a
+// restarting parent process are used when there are
 func (svr *Server) ListenAndServe(addr string) error {
+	listeners, err := InheritedListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		listeners, err = listen(addr, svr.config().Acceptors)
+		if err != nil {
+			return err
+		}
+	}
+	if len(listeners) == 1 {
+		return svr.Serve(listeners[0])
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- svr.Serve(l)
+		}()
+	}
+	// stop all accept loops once any of them stops
+	err = <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	return err
+}
+
+// Serve serve on listener, it can be called for several listeners
+func (svr *Server) Serve(l net.Listener) error {
+	svr.mu.Lock()
+	svr.listeners = append(svr.listeners, l)
+	cfg := svr.cfg
 	var err error
-	svr.listener, err = net.Listen("tcp", addr)
+	if svr.limiter == nil {
+		svr.limiter, err = newConnLimiter(cfg)
+	}
+	svr.mu.Unlock()
+	defer svr.removeListener(l)
 	if err != nil {
 		return err
 	}
-	defer svr.listener.Close()
+	if len(cfg.TrustedProxies) > 0 {
+		trusted, err := proxyproto.ParsePrefixes(cfg.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		l = proxyproto.NewListener(l, trusted)
+	}
+	l = &limitListener{Listener: l, limiter: svr.limiter}
+	if cfg.HTTPHandler != nil {
+		mux := network.NewMux(l)
+		defer mux.Close()
+		hs := &http.Server{Handler: cfg.HTTPHandler}
+		svr.mu.Lock()
+		svr.httpServers = append(svr.httpServers, hs)
+		svr.mu.Unlock()
+		go hs.Serve(mux.HTTP())
+		go mux.Serve()
+		l = mux.CRPC()
+	}
 	for {
-		conn, err := svr.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logging.Error("accept: %v", err)
+			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 		go svr.handle(conn)
 	}
 }
 
-// Close close server
+// Rejected returns the number of connections rejected by the ip lists,
+// connection limits and OnConnect
+func (svr *Server) Rejected() uint64 {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	if svr.limiter == nil {
+		return 0
+	}
+	return svr.limiter.rejected.Load()
+}
+
+// Close close all listeners and the connections of HTTPHandler
 func (svr *Server) Close() error {
-	return svr.listener.Close()
+	err := svr.closeListeners()
+	for _, hs := range svr.takeHTTPServers() {
+		hs.Close()
+	}
+	return err
+}
+
+func (svr *Server) closeListeners() error {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	var err error
+	for _, l := range svr.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// removeListener close l and forget it, RestartCommand passes the
+// remaining listeners only
+func (svr *Server) removeListener(l net.Listener) {
+	l.Close()
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	// copy on write, RestartCommand uses the slice without the lock
+	listeners := make([]net.Listener, 0, len(svr.listeners))
+	for _, ln := range svr.listeners {
+		if ln != l {
+			listeners = append(listeners, ln)
+		}
+	}
+	svr.listeners = listeners
+}
+
+// takeHTTPServers returns the http servers and forgets them
+func (svr *Server) takeHTTPServers() []*http.Server {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	servers := svr.httpServers
+	svr.httpServers = nil
+	return servers
+}
+
+// Shutdown stop accepting new connections, then close every connection
+// once it has no pending request or open stream. The remaining connections
+// are closed forcibly when ctx is done, and so are the ones finishing
+// their handshakes after Shutdown is called. The connections of
+// HTTPHandler are shut down by http.Server.Shutdown.
+func (svr *Server) Shutdown(ctx context.Context) error {
+	svr.mu.Lock()
+	svr.shutdown = true
+	svr.mu.Unlock()
+	err := svr.closeListeners()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, hs := range svr.takeHTTPServers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hs.Shutdown(ctx) != nil {
+				hs.Close()
+			}
+		}()
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if svr.closeIdle(false) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			svr.closeIdle(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdle close idle connections or all of them when force is set,
+// returns the number of connections still alive
+func (svr *Server) closeIdle(force bool) int {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	for _, sess := range svr.sessions {
+		if force || sess.tp.busy.Load() == 0 {
+			sess.tp.Close()
+		}
+	}
+	return len(svr.sessions)
 }
 
 func (svr *Server) handle(conn net.Conn) {
 	defer conn.Close()
+	svrCfg := svr.config()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	encrypter := svrCfg.Encrypter
+	if svrCfg.KeyExchange != nil {
+		enc, err := svrCfg.KeyExchange.Handshake(conn, encrypt.RoleServer)
+		if err != nil {
+			logging.Error("key exchange %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		encrypter = enc
+	}
+	var info ConnInfo
+	connCfg := ConnConfig{
+		Encrypter:  encrypter,
+		Compresser: svrCfg.Compresser,
+		Codec:      svrCfg.Codec,
+		OnRequest:  svrCfg.OnRequest,
+		OnAccept:   svrCfg.OnAccept,
+	}
+	// the rejection of OnConnect is sent in the auth handshake
+	connect := func(identity any) error {
+		info = ConnInfo{
+			RemoteAddr:  conn.RemoteAddr(),
+			LocalAddr:   conn.LocalAddr(),
+			Identity:    identity,
+			ConnectedAt: time.Now(),
+		}
+		if svrCfg.OnConnect == nil {
+			return nil
+		}
+		cfg, err := svrCfg.OnConnect(info)
+		if err != nil {
+			svr.limiter.rejected.Add(1)
+			logging.Info("reject %s: %v", conn.RemoteAddr(), err)
+			return err
+		}
+		connCfg.merge(cfg)
+		return nil
+	}
+	var identity any
+	if svrCfg.Authenticate != nil {
+		var err error
+		identity, err = serverAuth(conn, cloneEncrypter(encrypter), svrCfg.Authenticate, connect)
+		if err != nil {
+			logging.Error("auth %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	} else if connect(nil) != nil {
+		return
+	}
 	tp := new(conn)
-	tp.SetEncrypter(svr.encrypter)
-	tp.SetCompresser(svr.compresser)
+	tp.identity = identity
+	tp.namedStreams = svrCfg.NamedStreams
+	tp.codecConfig = svrCfg.CodecConfig
+	tp.SetLimits(svrCfg.Limits)
+	tp.SetEncrypter(connCfg.Encrypter)
+	tp.SetCompresser(connCfg.Compresser)
+	tp.SetCodec(connCfg.Codec)
+	// the keys of the connection follow UpdateConfig only when they come
+	// from the server config
+	var keys *encrypt.KeyRing
+	if svrCfg.KeyExchange == nil {
+		ring, ok := svrCfg.Encrypter.(*encrypt.KeyRing)
+		connRing, ok2 := connCfg.Encrypter.(*encrypt.KeyRing)
+		if ok && ok2 && ring == connRing {
+			keys = ring
+		}
+	}
+	sess := svr.register(tp, keys)
+	if sess == nil {
+		tp.Close()
+		logging.Info("reject %s: %v", conn.RemoteAddr(), ErrClosed)
+		if svrCfg.OnDisconnect != nil {
+			svrCfg.OnDisconnect(info, ErrClosed)
+		}
+		return
+	}
+	defer svr.unregister(sess)
 	defer tp.Close()
-	tp.SetOnRequest(svr.onRequest)
-	go svr.acceptStream(tp)
-	tp.Serve()
+	onRequest := connCfg.OnRequest
+	if onRequest != nil {
+		onRequest = svr.authorize(onRequest)
+	}
+	tp.SetOnRequest(onRequest)
+	go tp.acceptStreams(connCfg.OnAccept, svr.checkStream)
+	err := tp.Serve()
+	if svrCfg.OnDisconnect != nil {
+		svrCfg.OnDisconnect(info, err)
+	}
 }
 
-func (svr *Server) acceptStream(tp *transport) {
-	for {
-		stream, err := tp.AcceptStream()
-		if err != nil {
-			logging.Error("accept stream: %v", err)
-			return
+// authorize check the requests by the current policy
+func (svr *Server) authorize(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if policy := svr.config().Policy; policy != nil {
+			return policy.authorize(next)(r)
 		}
-		go svr.onAcceptStream(stream)
+		return next(r)
+	}
+}
+
+// merge replace the fields by the non-nil ones of cfg
+func (cfg *ConnConfig) merge(other ConnConfig) {
+	if other.Encrypter != nil {
+		cfg.Encrypter = other.Encrypter
+	}
+	if other.Compresser != nil {
+		cfg.Compresser = other.Compresser
+	}
+	if other.Codec != nil {
+		cfg.Codec = other.Codec
+	}
+	if other.OnRequest != nil {
+		cfg.OnRequest = other.OnRequest
+	}
+	if other.OnAccept != nil {
+		cfg.OnAccept = other.OnAccept
+	}
+}
+
+// checkStream returns the reason to refuse the stream
+func (svr *Server) checkStream(stream *Stream) error {
+	identity := stream.parent.identity
+	if policy := svr.config().Policy; policy != nil && !policy.AllowStream(identity, stream.name) {
+		logging.Info("policy: deny stream %q for %v from %s",
+			stream.name, identity, stream.parent.conn.RemoteAddr())
+		return errForbidden
 	}
+	return nil
 }
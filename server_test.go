@@ -0,0 +1,349 @@
+package crpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc/encoding"
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/encrypt"
+)
+
+func TestOnConnect(t *testing.T) {
+	keys := map[string]*encrypt.Key{
+		"alice": encrypt.KeyFromSecret([]byte("alice key"), nil),
+		"bob":   encrypt.KeyFromSecret([]byte("bob key"), nil),
+	}
+	ids := map[string]uint32{"alice": 1, "bob": 2}
+	ring := encrypt.NewKeyRing()
+	for name, key := range keys {
+		ring.Add(ids[name], encrypt.New(encrypt.AesGCM, key, encrypt.RoleServer))
+	}
+	ring.SetFollowPeer(true)
+	disconnected := make(chan ConnInfo, 1)
+	svr, addr := newTestServer(t, ServerConfig{
+		Encrypter: ring,
+		Authenticate: func(info AuthInfo) (any, error) {
+			return string(info.Credential), nil
+		},
+		OnConnect: func(info ConnInfo) (ConnConfig, error) {
+			name := info.Identity.(string)
+			if name == "bob" {
+				return ConnConfig{}, errors.New("suspended")
+			}
+			// pin the key of the tenant
+			tenant := encrypt.NewKeyRing()
+			tenant.Add(ids[name], encrypt.New(encrypt.AesGCM, keys[name], encrypt.RoleServer))
+			return ConnConfig{
+				Encrypter: tenant,
+				OnRequest: reply(name),
+			}, nil
+		},
+		OnDisconnect: func(info ConnInfo, err error) {
+			disconnected <- info
+		},
+	})
+	dial := func(name string) (*Client, error) {
+		enc := encrypt.NewKeyRing()
+		enc.Add(ids[name], encrypt.New(encrypt.AesGCM, keys[name], encrypt.RoleClient))
+		return NewClientWithConfig(addr, ClientConfig{
+			Encrypter:   enc,
+			Credentials: TokenCredentials(name),
+		})
+	}
+	cli, err := dial("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := call(cli); err != nil || got != "alice" {
+		t.Fatalf("call alice: %q, %v", got, err)
+	}
+	cli.Close()
+	select {
+	case info := <-disconnected:
+		if info.Identity != "alice" {
+			t.Fatalf("unexpected identity: %v", info.Identity)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+
+	if _, err := dial("bob"); err == nil {
+		t.Fatal("rejected client connected")
+	}
+	if svr.Rejected() != 1 {
+		t.Fatalf("unexpected rejected count: %d", svr.Rejected())
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	key1 := encrypt.New(encrypt.AesGCM, encrypt.KeyFromSecret([]byte("key 1"), nil), encrypt.RoleServer)
+	key2 := encrypt.New(encrypt.AesGCM, encrypt.KeyFromSecret([]byte("key 2"), nil), encrypt.RoleServer)
+	ring := encrypt.NewKeyRing()
+	ring.Add(1, key1)
+	svr, addr := newTestServer(t, ServerConfig{
+		Encrypter: ring,
+		OnRequest: reply("v1"),
+	})
+	cliRing := encrypt.NewKeyRing()
+	cliRing.Add(1, encrypt.New(encrypt.AesGCM, encrypt.KeyFromSecret([]byte("key 1"), nil), encrypt.RoleClient))
+	cliRing.Add(2, encrypt.New(encrypt.AesGCM, encrypt.KeyFromSecret([]byte("key 2"), nil), encrypt.RoleClient))
+	cli, err := NewClientWithConfig(addr, ClientConfig{Encrypter: cliRing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if got, err := call(cli); err != nil || got != "v1" {
+		t.Fatalf("call v1: %q, %v", got, err)
+	}
+
+	for _, cfg := range []ServerConfig{
+		{AllowCIDRs: []string{"invalid"}},
+		{TrustedProxies: []string{"invalid"}},
+	} {
+		if err := svr.UpdateConfig(cfg); err == nil {
+			t.Fatal("invalid config applied")
+		}
+	}
+	// rotate to key 2 with a reloaded key ring
+	reloaded := encrypt.NewKeyRing()
+	reloaded.Add(1, key1)
+	reloaded.Add(2, key2)
+	reloaded.SetPrimary(2)
+	err = svr.UpdateConfig(ServerConfig{
+		Encrypter: reloaded,
+		OnRequest: reply("v2"),
+		Limits:    Limits{MaxPendingCalls: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliRing.SetPrimary(2)
+	cliRing.Remove(1)
+	// the live connection keeps its handler and follows the keys
+	if got, err := call(cli); err != nil || got != "v1" {
+		t.Fatalf("call live connection: %q, %v", got, err)
+	}
+	sess := svr.Sessions().List(nil)
+	if len(sess) != 1 || sess[0].tp.limits().MaxPendingCalls != 1 {
+		t.Fatal("limits not applied to the live connection")
+	}
+	cli2, err := NewClientWithConfig(addr, ClientConfig{Encrypter: cliRing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	if got, err := call(cli2); err != nil || got != "v2" {
+		t.Fatalf("call v2: %q, %v", got, err)
+	}
+}
+
+func TestUpdateConfigDeny(t *testing.T) {
+	svr, addr := newTestServer(t, ServerConfig{OnRequest: reply("ok")})
+	cli, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := call(cli); err != nil {
+		t.Fatal(err)
+	}
+	sess := svr.Sessions().List(nil)
+	if len(sess) != 1 {
+		t.Fatalf("unexpected sessions: %d", len(sess))
+	}
+	err = svr.UpdateConfig(ServerConfig{
+		OnRequest: reply("ok"),
+		DenyCIDRs: []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sess[0].Done():
+		t.Fatal("allowed session closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = svr.UpdateConfig(ServerConfig{
+		OnRequest: reply("ok"),
+		DenyCIDRs: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sess[0].Done():
+	case <-time.After(time.Second):
+		t.Fatal("denied session not closed")
+	}
+}
+
+// xorEncrypter encrypter of a value type that is not comparable
+type xorEncrypter struct {
+	key []byte
+}
+
+func (e xorEncrypter) Encrypt(data []byte) ([]byte, error) {
+	ret := make([]byte, len(data))
+	for i, b := range data {
+		ret[i] = b ^ e.key[i%len(e.key)]
+	}
+	return ret, nil
+}
+
+func (e xorEncrypter) Decrypt(data []byte) ([]byte, error) {
+	return e.Encrypt(data)
+}
+
+func TestUpdateConfigNotComparable(t *testing.T) {
+	enc := xorEncrypter{key: []byte("key")}
+	svr, addr := newTestServer(t, ServerConfig{
+		Encrypter: enc,
+		OnRequest: reply("ok"),
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{Encrypter: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if got, err := call(cli); err != nil || got != "ok" {
+		t.Fatalf("call: %q, %v", got, err)
+	}
+	err = svr.UpdateConfig(ServerConfig{
+		Encrypter: xorEncrypter{key: []byte("key")},
+		OnRequest: reply("ok"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli2, err := NewClientWithConfig(addr, ClientConfig{Encrypter: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	if got, err := call(cli2); err != nil || got != "ok" {
+		t.Fatalf("call after update: %q, %v", got, err)
+	}
+}
+
+// countCodec counts the marshaled messages
+type countCodec struct {
+	encoding.Codec
+	n atomic.Int64
+}
+
+func (c *countCodec) Marshal(v any) ([]byte, error) {
+	c.n.Add(1)
+	return c.Codec.Marshal(v)
+}
+
+func TestCodec(t *testing.T) {
+	svrCodec := &countCodec{Codec: codec.New()}
+	_, addr := newTestServer(t, ServerConfig{
+		Codec:     svrCodec,
+		OnRequest: reply("pong"),
+	})
+	cliCodec := &countCodec{Codec: codec.New()}
+	cli, err := NewClientWithConfig(addr, ClientConfig{Codec: cliCodec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if got, err := call(cli); err != nil || got != "pong" {
+		t.Fatalf("call: %q, %v", got, err)
+	}
+	if cliCodec.n.Load() != 1 || svrCodec.n.Load() != 1 {
+		t.Fatalf("codec not used: %d, %d", cliCodec.n.Load(), svrCodec.n.Load())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{})
+	svr := NewServer(ServerConfig{
+		// the handler never closes the stream
+		OnAccept: func(*Stream) { close(accepted) },
+	})
+	served := make(chan struct{})
+	go func() {
+		svr.Serve(l)
+		close(served)
+	}()
+	cli, err := NewClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	s.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("stream closed by the remote side blocked shutdown")
+	}
+	<-served
+	svr.mu.Lock()
+	n := len(svr.listeners)
+	svr.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("closed listeners are kept: %d", n)
+	}
+}
+
+func TestShutdownDuringHandshake(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	disconnected := make(chan error, 1)
+	svr, addr := newTestServer(t, ServerConfig{
+		Authenticate: func(AuthInfo) (any, error) {
+			close(started)
+			<-release
+			return nil, nil
+		},
+		OnDisconnect: func(_ ConnInfo, err error) {
+			disconnected <- err
+		},
+	})
+	go func() {
+		cli, err := NewClientWithConfig(addr, ClientConfig{
+			Credentials: TokenCredentials("token"),
+		})
+		if err == nil {
+			cli.Close()
+		}
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	select {
+	case err := <-disconnected:
+		if err != ErrClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	if n := svr.Sessions().Len(); n != 0 {
+		t.Fatalf("registered after shutdown: %d", n)
+	}
+}
@@ -0,0 +1,243 @@
+package crpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lwch/crpc/encoding/encrypt"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+type sessionKey struct{}
+
+// Session connection of a client on the server, it calls the handlers set
+// by ClientConfig.OnRequest and ClientConfig.OnAccept, e.g. for agents
+// behind NAT
+type Session struct {
+	tp          *transport
+	id          uint64
+	connectedAt time.Time
+	mu          sync.RWMutex
+	attrs       map[string]any
+	// keys key ring of the server config the connection follows, see
+	// Server.UpdateConfig
+	keys *encrypt.KeyRing
+}
+
+// SessionFromContext returns the session of the connection, the context
+// is from an incoming request or Stream.Context on the server
+func SessionFromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionKey{}).(*Session)
+	return sess
+}
+
+// Session returns the session of the stream on the server, it is nil on
+// the client
+func (s *Stream) Session() *Session {
+	return s.parent.session
+}
+
+// ID returns the id of the session, it is unique in the server
+func (sess *Session) ID() uint64 {
+	return sess.id
+}
+
+// ConnectedAt returns the time the client connected
+func (sess *Session) ConnectedAt() time.Time {
+	return sess.connectedAt
+}
+
+// Get returns the user defined attribute
+func (sess *Session) Get(key string) any {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.attrs[key]
+}
+
+// Set set the user defined attribute, e.g. the agent name for lookups
+func (sess *Session) Set(key string, value any) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.attrs == nil {
+		sess.attrs = make(map[string]any)
+	}
+	sess.attrs[key] = value
+}
+
+// RemoteAddr returns the remote address of the client
+func (sess *Session) RemoteAddr() net.Addr {
+	return sess.tp.conn.RemoteAddr()
+}
+
+// Identity returns the identity returned by ServerConfig.Authenticate
+func (sess *Session) Identity() any {
+	return sess.tp.identity
+}
+
+// Done returns a channel that is closed when the connection is closed
+func (sess *Session) Done() <-chan struct{} {
+	return sess.tp.ctx.Done()
+}
+
+// Close close the connection
+func (sess *Session) Close() error {
+	return sess.tp.Close()
+}
+
+// Call call http request on the client
+func (sess *Session) Call(ctx context.Context, req *http.Request) (*http.Response, error) {
+	select {
+	case <-sess.tp.ctx.Done():
+		return nil, ErrClosed
+	default:
+	}
+	return sess.tp.Call(ctx, req)
+}
+
+// OpenStream open stream to the client
+func (sess *Session) OpenStream(ctx context.Context) (*Stream, error) {
+	return sess.OpenNamedStream(ctx, "")
+}
+
+// OpenNamedStream open stream with name to the client, it requires
+// ServerConfig.NamedStreams
+func (sess *Session) OpenNamedStream(ctx context.Context, name string) (*Stream, error) {
+	select {
+	case <-sess.tp.ctx.Done():
+		return nil, ErrClosed
+	default:
+	}
+	return sess.tp.OpenStream(ctx, name)
+}
+
+// register register the connection, keys is the key ring of the server
+// config the connection got its keys from, nil when it has its own keys.
+// It returns nil after Shutdown is called.
+func (svr *Server) register(tp *transport, keys *encrypt.KeyRing) *Session {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	if svr.shutdown {
+		return nil
+	}
+	svr.sessionID++
+	sess := &Session{
+		tp:          tp,
+		id:          svr.sessionID,
+		connectedAt: time.Now(),
+		keys:        keys,
+	}
+	// the config may be updated during the handshakes
+	svr.apply(sess)
+	tp.session = sess
+	svr.sessions[sess.id] = sess
+	return sess
+}
+
+func (svr *Server) unregister(sess *Session) {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	delete(svr.sessions, sess.id)
+}
+
+// SessionRegistry sessions of the connected clients
+type SessionRegistry struct {
+	svr *Server
+}
+
+// Sessions returns the registry of the connected clients
+func (svr *Server) Sessions() *SessionRegistry {
+	return &SessionRegistry{svr: svr}
+}
+
+// List returns the sessions ordered by id, filter is optional
+func (r *SessionRegistry) List(filter func(*Session) bool) []*Session {
+	r.svr.mu.Lock()
+	ret := make([]*Session, 0, len(r.svr.sessions))
+	for _, sess := range r.svr.sessions {
+		ret = append(ret, sess)
+	}
+	r.svr.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].id < ret[j].id
+	})
+	if filter == nil {
+		return ret
+	}
+	filtered := ret[:0]
+	for _, sess := range ret {
+		if filter(sess) {
+			filtered = append(filtered, sess)
+		}
+	}
+	return filtered
+}
+
+// Len returns the number of sessions
+func (r *SessionRegistry) Len() int {
+	r.svr.mu.Lock()
+	defer r.svr.mu.Unlock()
+	return len(r.svr.sessions)
+}
+
+// Get returns the session of id, nil when not found
+func (r *SessionRegistry) Get(id uint64) *Session {
+	r.svr.mu.Lock()
+	defer r.svr.mu.Unlock()
+	return r.svr.sessions[id]
+}
+
+// Kick disconnect the session of id
+func (r *SessionRegistry) Kick(id uint64) error {
+	sess := r.Get(id)
+	if sess == nil {
+		return errSessionNotFound
+	}
+	return sess.Close()
+}
+
+// BroadcastResult result of the call on one session
+type BroadcastResult struct {
+	Session  *Session
+	Response *http.Response
+	Err      error
+}
+
+// Broadcast call the request on every session matched by filter
+// concurrently, filter nil means all sessions, the request body is read
+// once and sent to every session
+func (r *SessionRegistry) Broadcast(ctx context.Context, req *http.Request, filter func(*Session) bool) ([]BroadcastResult, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sessions := r.List(filter)
+	results := make([]BroadcastResult, len(sessions))
+	var wg sync.WaitGroup
+	for i, sess := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clone := req.Clone(ctx)
+			if req.Body != nil {
+				clone.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			resp, err := sess.Call(ctx, clone)
+			results[i] = BroadcastResult{Session: sess, Response: resp, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
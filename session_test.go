@@ -0,0 +1,146 @@
+package crpc
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func echo(s *Stream) {
+	defer s.Close()
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := s.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func ping(t *testing.T, s *Stream, msg string) {
+	if _, err := s.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Fatalf("unexpected data: %s", buf[:n])
+	}
+}
+
+func TestSession(t *testing.T) {
+	sessions := make(chan *Session, 1)
+	_, addr := newTestServer(t, ServerConfig{
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			sessions <- SessionFromContext(r.Context())
+			return reply("registered")(r)
+		},
+		OnAccept: echo,
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		OnRequest: reply("agent"),
+		OnAccept:  echo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := call(cli); err != nil {
+		t.Fatal(err)
+	}
+	sess := <-sessions
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://agent/status", nil)
+	rep, err := sess.Call(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rep.Body)
+	if string(data) != "agent" {
+		t.Fatalf("unexpected response: %s", data)
+	}
+	// streams opened by both sides share the same stream ids
+	toClient, err := sess.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toClient.Close()
+	toServer, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toServer.Close()
+	ping(t, toClient, "to client")
+	ping(t, toServer, "to server")
+}
+
+func TestSessionRegistry(t *testing.T) {
+	svr, addr := newTestServer(t, ServerConfig{
+		Authenticate: func(info AuthInfo) (any, error) {
+			return string(info.Credential), nil
+		},
+		OnRequest: func(r *http.Request) (*http.Response, error) {
+			SessionFromContext(r.Context()).Set("group", r.URL.Query().Get("group"))
+			return reply("registered")(r)
+		},
+	})
+	for i, name := range []string{"a", "b", "c"} {
+		cli, err := NewClientWithConfig(addr, ClientConfig{
+			Credentials: TokenCredentials(name),
+			OnRequest:   reply(name),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/register?group="+[]string{"x", "x", "y"}[i], nil)
+		if _, err := cli.Call(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := svr.Sessions().Len(); n != 3 {
+		t.Fatalf("unexpected sessions: %d", n)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://agent/name", nil)
+	results, err := svr.Sessions().Broadcast(context.Background(), req, func(sess *Session) bool {
+		return sess.Get("group") == "x"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("unexpected results: %d", len(results))
+	}
+	for _, ret := range results {
+		if ret.Err != nil {
+			t.Fatal(ret.Err)
+		}
+		data, _ := io.ReadAll(ret.Response.Body)
+		if string(data) != ret.Session.Identity() {
+			t.Fatalf("unexpected response: %s", data)
+		}
+	}
+	first := svr.Sessions().List(nil)[0]
+	if first.Identity() != "a" {
+		t.Fatalf("unexpected identity: %v", first.Identity())
+	}
+	if err := svr.Sessions().Kick(first.ID()); err != nil {
+		t.Fatal(err)
+	}
+	<-first.Done()
+	for i := 0; svr.Sessions().Get(first.ID()) != nil; i++ {
+		if i > 100 {
+			t.Fatal("kicked session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,71 +1,271 @@
 package crpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+
 	"github.com/lwch/crpc/network"
+	"github.com/lwch/logging"
 )
 
+// ErrStreamRefused stream refused by the remote side
+var ErrStreamRefused = errors.New("stream refused")
+
+// ErrSendTooLarge message of Stream.Send is larger than MaxSendSize after
+// compression and encryption
+var ErrSendTooLarge = errors.New("stream: message too large")
+
+var errStreamNotAccepted = errors.New("streams are not accepted")
+var errNamedStreams = errors.New("named streams are not enabled")
+
+// 启用NamedStreams时，打开stream后打开方首先发送stream名称，接收方回复
+// Status(1) | Message，Status为0表示接受，否则Message中为拒绝原因。未启用时
+// 与旧版本协议一致，被拒绝的stream直接关闭
+
+// maxWriteSize max size of the data sent in a message by Write, larger
+// data is split into several messages
+const maxWriteSize = 32 << 10
+
+// MaxSendSize max size of a message sent by Stream.Send after compression
+// and encryption, messages are not split, send larger data by Write
+const MaxSendSize = math.MaxUint16
+
 // Stream stream
 type Stream struct {
 	parent *transport
 	s      *network.Stream
+	name   string
+	closed atomic.Bool
+	// unread data of the last message
+	buf []byte
+}
+
+// Name returns the name of the stream, see Client.OpenNamedStream
+func (s *Stream) Name() string {
+	return s.name
+}
+
+// open send the name and wait for the reply of the remote side
+func (s *Stream) open(ctx context.Context) error {
+	if _, err := s.Write([]byte(s.name)); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.s.Close()
+		case <-done:
+		}
+	}()
+	buf := make([]byte, 65535)
+	n, err := s.Read(buf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if n == 0 || buf[0] != 0 {
+		if n > 0 {
+			n--
+			buf = buf[1:]
+		}
+		return fmt.Errorf("%w: %s", ErrStreamRefused, buf[:n])
+	}
+	return nil
+}
+
+// readName read the name sent by the opening side
+func (s *Stream) readName() error {
+	buf := make([]byte, 65535)
+	n, err := s.Read(buf)
+	if err != nil {
+		return err
+	}
+	s.name = string(buf[:n])
+	return nil
+}
+
+// reply accept the stream when err is nil, otherwise refuse it
+func (s *Stream) reply(err error) error {
+	if err == nil {
+		_, err := s.Write([]byte{0})
+		return err
+	}
+	_, e := s.Write(append([]byte{1}, err.Error()...))
+	return e
+}
+
+// Context returns the context of the connection, it carries the identity
+// of the connection and is done when the connection is closed, see
+// IdentityFromContext
+func (s *Stream) Context() context.Context {
+	return s.parent.context()
 }
 
 // Close close stream
 func (s *Stream) Close() error {
+	s.release()
 	return s.s.Close()
 }
 
+// release stop counting the stream in busy
+func (s *Stream) release() {
+	if s.closed.CompareAndSwap(false, true) {
+		s.parent.busy.Add(-1)
+	}
+}
+
 // Write write data in stream
 func (s *Stream) Write(p []byte) (int, error) {
-	data, err := s.parent.codec.Marshal(p)
+	// empty data is sent as an empty message
+	n := 0
+	for {
+		size := min(len(p)-n, maxWriteSize)
+		if err := s.send(p[n : n+size]); err != nil {
+			return n, err
+		}
+		n += size
+		if n >= len(p) {
+			return n, nil
+		}
+	}
+}
+
+// Send send v in a message, the data types of codec are supported, e.g.
+// structs are sent as json, ErrSendTooLarge is returned when the encoded
+// message is larger than MaxSendSize
+func (s *Stream) Send(v any) error {
+	return s.send(v)
+}
+
+func (s *Stream) send(v any) error {
+	data, err := s.parent.codec().Marshal(v)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	if s.parent.compresser != nil {
 		data, err = s.parent.compresser.Compress(data)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
 	if s.parent.encrypter != nil {
 		data, err = s.parent.encrypter.Encrypt(data)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
-	_, err = s.s.Write(data)
-	if err != nil {
-		return 0, err
+	if len(data) > MaxSendSize {
+		return ErrSendTooLarge
 	}
-	return len(p), nil
+	_, err = s.s.Write(data)
+	return err
 }
 
-// Read read data from stream
+// Read read data from stream, the data of a message not fitting in p is
+// returned by the next Read
 func (s *Stream) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		buf, err := s.recv()
+		if err != nil {
+			return 0, err
+		}
+		if buf == nil {
+			return 0, nil
+		}
+		var data []byte
+		if _, err := s.parent.codec().Unmarshal(buf, &data); err != nil {
+			return 0, err
+		}
+		s.buf = data
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Recv receive a message sent by Send into the pointer v, json objects are
+// received as map[string]any when v is *any
+func (s *Stream) Recv(v any) error {
+	for {
+		buf, err := s.recv()
+		if err != nil {
+			return err
+		}
+		if buf != nil {
+			_, err = s.parent.codec().Unmarshal(buf, v)
+			return err
+		}
+	}
+}
+
+// recv returns the next decoded message, nil when it is empty
+func (s *Stream) recv() ([]byte, error) {
 	buf := make([]byte, 65535)
 	n, err := s.s.Read(buf)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if n == 0 {
-		return 0, nil
+		return nil, nil
 	}
 	buf = buf[:n]
 	if s.parent.encrypter != nil {
 		buf, err = s.parent.encrypter.Decrypt(buf)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
-	if s.parent.compresser != nil {
-		buf, err = s.parent.compresser.Decompress(buf)
+	return s.parent.decompress(buf)
+}
+
+// acceptStreams accept streams until the connection is closed, streams
+// are refused when handler is nil or check returns an error
+func (tp *transport) acceptStreams(handler AcceptStreamHandlerFunc, check func(*Stream) error) {
+	for {
+		stream, err := tp.AcceptStream()
 		if err != nil {
-			return 0, err
+			logging.Error("accept stream: %v", err)
+			return
+		}
+		go tp.serveStream(stream, handler, check)
+	}
+}
+
+func (tp *transport) serveStream(stream *Stream, handler AcceptStreamHandlerFunc, check func(*Stream) error) {
+	if !tp.namedStreams {
+		if handler == nil || (check != nil && check(stream) != nil) {
+			stream.Close()
+			return
 		}
+		handler(stream)
+		return
+	}
+	if err := stream.readName(); err != nil {
+		logging.Error("read stream name: %v", err)
+		stream.Close()
+		return
+	}
+	var err error
+	if handler == nil {
+		err = errStreamNotAccepted
+	} else if check != nil {
+		err = check(stream)
+	}
+	if err := stream.reply(err); err != nil {
+		logging.Error("reply stream: %v", err)
+		stream.Close()
+		return
 	}
-	n, err = s.parent.codec.Unmarshal(buf, &p)
 	if err != nil {
-		return 0, err
+		stream.Close()
+		return
 	}
-	return n, nil
+	handler(stream)
 }
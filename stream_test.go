@@ -0,0 +1,145 @@
+package crpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lwch/crpc/encoding/codec"
+	"github.com/lwch/crpc/encoding/compress"
+	"github.com/lwch/crpc/test_data/pb"
+)
+
+func TestStreamSend(t *testing.T) {
+	type message struct {
+		Seq  int    `json:"seq"`
+		Text string `json:"text"`
+	}
+	_, addr := newTestServer(t, ServerConfig{
+		OnAccept: func(s *Stream) {
+			defer s.Close()
+			for {
+				var msg message
+				if err := s.Recv(&msg); err != nil {
+					return
+				}
+				msg.Seq++
+				if err := s.Send(msg); err != nil {
+					return
+				}
+			}
+		},
+	})
+	cli, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Send(&message{Seq: 1, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg message
+	if err := s.Recv(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq != 2 || msg.Text != "hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if err := s.Send(make([]byte, MaxSendSize)); err != ErrSendTooLarge {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCodecConfig(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		OnAccept: func(s *Stream) {
+			defer s.Close()
+			var msg any
+			if err := s.Recv(&msg); err != nil {
+				s.Send([]byte("unnamed"))
+				return
+			}
+			s.Send(msg)
+		},
+	})
+	send := func(cfg codec.Config) any {
+		cli, err := NewClientWithConfig(addr, ClientConfig{CodecConfig: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s, err := cli.OpenStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.Send(&pb.Request{Id: 1}); err != nil {
+			t.Fatal(err)
+		}
+		var msg any
+		if err := s.Recv(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if req, ok := send(codec.Config{}).(*pb.Request); !ok || req.Id != 1 {
+		t.Fatal("named message not decoded into *any")
+	}
+	// the message type is unknown without the name
+	if msg, ok := send(codec.Config{LegacyProtobuf: true}).([]byte); !ok || string(msg) != "unnamed" {
+		t.Fatalf("unexpected reply of legacy message: %v", msg)
+	}
+}
+
+func TestStreamEncoder(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{
+		Compresser: compress.New(compress.Gzip),
+		OnAccept: func(s *Stream) {
+			defer s.Close()
+			var req http.Request
+			if err := codec.NewDecoder(s).Decode(&req); err != nil {
+				return
+			}
+			n, _ := io.Copy(io.Discard, req.Body)
+			codec.NewEncoder(s).Encode(map[string]int64{"size": n})
+		},
+	})
+	cli, err := NewClientWithConfig(addr, ClientConfig{
+		Compresser: compress.New(compress.Gzip),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := cli.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	body := bytes.Repeat([]byte("crpc"), 50000)
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/upload", bytes.NewReader(body))
+	if err := codec.NewEncoder(s).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	var rep map[string]int64
+	if err := codec.NewDecoder(s).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep["size"] != int64(len(body)) {
+		t.Fatalf("unexpected size: %d", rep["size"])
+	}
+}
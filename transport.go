@@ -1,6 +1,7 @@
 package crpc
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -25,18 +26,41 @@ var ErrDone = errors.New("transport: done")
 
 var errDataType = errors.New("transport: data type error")
 
+// connSettings limits of the connection and the codec built with them
+type connSettings struct {
+	limits Limits
+	codec  encoding.Codec
+}
+
 // RequestHandlerFunc request handler
 type RequestHandlerFunc func(*http.Request) (*http.Response, error)
 
 type transport struct {
 	conn       *network.Conn
-	codec      encoding.Codec
 	encrypter  encoding.Encrypter
 	compresser encoding.Compresser
 	sequence   atomic.Uint64
-	onResponse map[uint64]chan *http.Response
+	onResponse map[uint64]chan response
 	mResponse  sync.RWMutex
 	onRequest  RequestHandlerFunc
+	// identity returned by ServerConfig.Authenticate
+	identity any
+	// session of the connection on the server side
+	session *Session
+	// settings can be updated on the live connection, see SetLimits
+	settings atomic.Pointer[connSettings]
+	// userCodec replaces the default codec when set
+	userCodec encoding.Codec
+	// codecConfig config of the default codec, see ServerConfig.CodecConfig
+	codecConfig codec.Config
+	// namedStreams sends the stream names, see ServerConfig.NamedStreams
+	namedStreams bool
+	// pending counts calls waiting for responses, handling counts
+	// requests being handled
+	pending  atomic.Int64
+	handling atomic.Int64
+	// busy counts pending calls, handling requests and open streams
+	busy atomic.Int64
 	// runtime
 	err    error
 	ctx    context.Context
@@ -48,46 +72,119 @@ func new(conn net.Conn) *transport {
 	ctx, cancel := context.WithCancel(context.Background())
 	t := &transport{
 		conn:       network.New(conn),
-		codec:      codec.New(),
-		onResponse: make(map[uint64]chan *http.Response),
+		onResponse: make(map[uint64]chan response),
 		onRequest: func(r *http.Request) (*http.Response, error) {
 			return &http.Response{}, nil
 		},
 		ctx:    ctx,
 		cancel: cancel,
 	}
+	t.SetLimits(Limits{})
 	go t.keepalive()
 	return t
 }
 
 func (tp *transport) SetEncrypter(encrypter encoding.Encrypter) {
-	tp.encrypter = encrypter
+	tp.encrypter = cloneEncrypter(encrypter)
+}
+
+// cloneEncrypter clone the encrypter for a new connection, see
+// encoding.Cloner
+func cloneEncrypter(encrypter encoding.Encrypter) encoding.Encrypter {
+	if cloner, ok := encrypter.(encoding.Cloner); ok {
+		return cloner.Clone()
+	}
+	return encrypter
+}
+
+// context returns the context of the connection carrying its identity,
+// it is done when the connection is closed
+func (tp *transport) context() context.Context {
+	ctx := context.WithValue(tp.ctx, identityKey{}, tp.identity)
+	if tp.session != nil {
+		ctx = context.WithValue(ctx, sessionKey{}, tp.session)
+	}
+	return ctx
+}
+
+func (tp *transport) SetLimits(limits Limits) {
+	if limits.MaxMessageSize <= 0 {
+		limits.MaxMessageSize = DefaultMaxMessageSize
+	}
+	c := tp.userCodec
+	if c == nil {
+		cfg := tp.codecConfig
+		if limits.MaxHeaderBytes > 0 {
+			cfg.MaxHeaderBytes = limits.MaxHeaderBytes
+		}
+		if limits.MaxHeaderCount > 0 {
+			cfg.MaxHeaderCount = limits.MaxHeaderCount
+		}
+		c = codec.NewWithConfig(cfg)
+	}
+	tp.settings.Store(&connSettings{
+		limits: limits,
+		codec:  c,
+	})
+}
+
+// SetCodec replace the default codec, nil restores it, it must be called
+// before the transport serves
+func (tp *transport) SetCodec(c encoding.Codec) {
+	tp.userCodec = c
+	tp.SetLimits(tp.limits())
+}
+
+func (tp *transport) limits() Limits {
+	return tp.settings.Load().limits
+}
+
+func (tp *transport) codec() encoding.Codec {
+	return tp.settings.Load().codec
 }
 
 func (tp *transport) SetCompresser(compresser encoding.Compresser) {
 	tp.compresser = compresser
 }
 
+// newStream create stream, it is counted in busy until it is closed by
+// either side
+func (tp *transport) newStream(s *network.Stream, name string) *Stream {
+	tp.busy.Add(1)
+	stream := &Stream{
+		parent: tp,
+		s:      s,
+		name:   name,
+	}
+	context.AfterFunc(s.Context(), stream.release)
+	return stream
+}
+
 func (tp *transport) AcceptStream() (*Stream, error) {
 	s, err := tp.conn.AcceptStream()
 	if err != nil {
 		return nil, err
 	}
-	return &Stream{
-		parent: tp,
-		s:      s,
-	}, nil
+	return tp.newStream(s, ""), nil
 }
 
-func (tp *transport) OpenStream(ctx context.Context) (*Stream, error) {
+func (tp *transport) OpenStream(ctx context.Context, name string) (*Stream, error) {
+	if !tp.namedStreams && len(name) > 0 {
+		return nil, errNamedStreams
+	}
 	s, err := tp.conn.OpenStream(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &Stream{
-		parent: tp,
-		s:      s,
-	}, nil
+	stream := tp.newStream(s, name)
+	if !tp.namedStreams {
+		return stream, nil
+	}
+	if err := stream.open(ctx); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
 }
 
 func (tp *transport) SetOnRequest(fn RequestHandlerFunc) {
@@ -99,11 +196,34 @@ func (tp *transport) Close() error {
 }
 
 func (tp *transport) Call(ctx context.Context, req *http.Request) (*http.Response, error) {
+	// count first so that concurrent calls can not exceed the limit
+	pending := tp.pending.Add(1)
+	defer tp.pending.Add(-1)
+	if max := tp.limits().MaxPendingCalls; max > 0 && pending > int64(max) {
+		return nil, ErrTooManyPendingCalls
+	}
+	var body *limitedBody
+	if max := tp.limits().MaxBodySize; max > 0 {
+		if req.ContentLength > max {
+			return nil, ErrBodyTooLarge
+		}
+		// the length of the body may be unknown
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &limitedBody{ReadCloser: req.Body, n: max}
+			req.Body = body
+		}
+	}
+	tp.busy.Add(1)
+	defer tp.busy.Add(-1)
 	data, reqID, err := tp.buildRequest(req)
+	// the error of the body is wrapped by http.Request.Write
+	if body != nil && body.n < 0 {
+		return nil, ErrBodyTooLarge
+	}
 	if err != nil {
 		return nil, err
 	}
-	ch := make(chan *http.Response, 1)
+	ch := make(chan response, 1)
 	tp.mResponse.Lock()
 	tp.onResponse[reqID] = ch
 	tp.mResponse.Unlock()
@@ -124,7 +244,16 @@ func (tp *transport) Call(ctx context.Context, req *http.Request) (*http.Respons
 		return nil, tp.err
 	case <-ctx.Done():
 		return nil, ErrDone
-	case resp := <-ch:
+	case ret := <-ch:
+		if ret.err != nil {
+			// dropped by the limits
+			return nil, ret.err
+		}
+		resp := ret.resp
+		resp.Body, resp.ContentLength, err = tp.readBody(resp.Body)
+		if err != nil {
+			return nil, err
+		}
 		return resp, nil
 	}
 }
@@ -144,6 +273,14 @@ func (tp *transport) Serve() error {
 			return err
 		}
 		err := tp.parse(buf[:n])
+		if isLimitError(err) {
+			logging.Error("drop message: %v", err)
+			var dropped *droppedError
+			if errors.As(err, &dropped) {
+				tp.reject(dropped)
+			}
+			continue
+		}
 		if err != nil {
 			logging.Error("parse: %v", err)
 			return err
@@ -159,62 +296,143 @@ func (tp *transport) parse(data []byte) error {
 	}
 	switch v := payload.(type) {
 	case *http.Request:
+		v = v.WithContext(tp.context())
+		v.RemoteAddr = tp.conn.RemoteAddr().String()
 		str := v.Header.Get(keyRequestID)
 		seq, _ := strconv.ParseUint(str, 10, 64)
-		go tp.handleRequest(v, seq)
+		handling := tp.handling.Add(1)
+		if max := tp.limits().MaxPendingCalls; max > 0 && handling > int64(max) {
+			tp.handling.Add(-1)
+			logging.Error("reject http call(%d): %v", seq, ErrTooManyPendingCalls)
+			tp.writeResponse(v, errorResponse(http.StatusServiceUnavailable, ErrTooManyPendingCalls), seq)
+			return nil
+		}
+		tp.busy.Add(1)
+		go func() {
+			defer tp.busy.Add(-1)
+			defer tp.handling.Add(-1)
+			tp.handleRequest(v, seq)
+		}()
 	case *http.Response:
 		str := v.Header.Get(keyRequestID)
 		seq, _ := strconv.ParseUint(str, 10, 64)
-		tp.mResponse.RLock()
-		ch := tp.onResponse[seq]
-		tp.mResponse.RUnlock()
-		if ch == nil {
-			return nil
-		}
-		// recover on closed
-		send := func(ch chan *http.Response, rep *http.Response) {
-			defer func() {
-				recover()
-			}()
-			ch <- rep
-		}
-		send(ch, v)
+		tp.deliver(seq, response{resp: v})
 	default:
 		return errDataType
 	}
 	return nil
 }
 
+// response response of the call or the error of the dropped response
+type response struct {
+	resp *http.Response
+	err  error
+}
+
+// deliver send the response to the waiting call
+func (tp *transport) deliver(seq uint64, rep response) {
+	tp.mResponse.RLock()
+	ch := tp.onResponse[seq]
+	tp.mResponse.RUnlock()
+	if ch == nil {
+		return
+	}
+	// recover on closed
+	defer func() {
+		recover()
+	}()
+	ch <- rep
+}
+
+// reject answers the request dropped by the limits with 413 or 431 for
+// the header limits and fails the call of the dropped response with the
+// error, the request id is read from the http header at the beginning of
+// the message
+func (tp *transport) reject(dropped *droppedError) {
+	head := dropped.head
+	if len(head) == 0 {
+		return
+	}
+	code := http.StatusRequestEntityTooLarge
+	if !errors.Is(dropped.err, ErrMessageTooLarge) {
+		code = http.StatusRequestHeaderFieldsTooLarge
+	}
+	r := bufio.NewReader(bytes.NewReader(head[1:]))
+	switch codec.DataType(head[0]) {
+	case codec.TypeHTTPRequest:
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		seq, err := strconv.ParseUint(req.Header.Get(keyRequestID), 10, 64)
+		if err != nil {
+			return
+		}
+		tp.writeResponse(req, errorResponse(code, dropped.err), seq)
+	case codec.TypeHTTPResponse:
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return
+		}
+		seq, err := strconv.ParseUint(resp.Header.Get(keyRequestID), 10, 64)
+		if err != nil {
+			return
+		}
+		tp.deliver(seq, response{err: dropped.err})
+	}
+}
+
+func errorResponse(code int, err error) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Body:       io.NopCloser(strings.NewReader(err.Error())),
+	}
+}
+
 func (tp *transport) handleRequest(req *http.Request, reqID uint64) {
 	hdr, _ := httputil.DumpRequest(req, false)
 	logging.Debug("> received http call(%d):\n%s", reqID, string(hdr))
 	if tp.onRequest == nil {
 		return
 	}
+	var err error
+	req.Body, req.ContentLength, err = tp.readBody(req.Body)
+	if err != nil {
+		logging.Error("read request body(%d): %v", reqID, err)
+		tp.writeResponse(req, errorResponse(http.StatusRequestEntityTooLarge, err), reqID)
+		return
+	}
 	resp, err := tp.onRequest(req)
 	if err != nil {
-		resp = &http.Response{
-			StatusCode: http.StatusInternalServerError,
-			Body:       io.NopCloser(strings.NewReader(err.Error())),
-		}
+		resp = errorResponse(http.StatusInternalServerError, err)
 	}
+	tp.writeResponse(req, resp, reqID)
+}
+
+func (tp *transport) writeResponse(req *http.Request, resp *http.Response, reqID uint64) {
 	resp.ProtoMajor = req.ProtoMajor
 	resp.ProtoMinor = req.ProtoMinor
 	if resp.Body != nil {
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, resp.Body); err != nil {
+		var err error
+		resp.Body, resp.ContentLength, err = tp.readBody(resp.Body)
+		if errors.Is(err, ErrBodyTooLarge) {
+			logging.Error("read body(%d): %v", reqID, err)
+			resp = errorResponse(http.StatusInternalServerError, err)
+			resp.ProtoMajor = req.ProtoMajor
+			resp.ProtoMinor = req.ProtoMinor
+			resp.Body, resp.ContentLength, err = tp.readBody(resp.Body)
+		}
+		if err != nil {
 			logging.Error("read body(%d): %v", reqID, err)
 			return
 		}
-		resp.ContentLength = int64(buf.Len())
-		resp.Body = io.NopCloser(&buf)
 	}
 	data, err := tp.buildResponse(resp, reqID)
 	if err != nil {
 		logging.Error("build response(%d): %v", reqID, err)
 		return
 	}
-	hdr, _ = httputil.DumpResponse(resp, false)
+	hdr, _ := httputil.DumpResponse(resp, false)
 	logging.Debug("< http response(%d):\n%s", reqID, string(hdr))
 	_, err = tp.conn.Write(data)
 	if err != nil {
@@ -224,6 +442,11 @@ func (tp *transport) handleRequest(req *http.Request, reqID uint64) {
 }
 
 func (tp *transport) keepalive() {
+	// send the first ping right away, so the peer sees traffic before any
+	// call is made, e.g. for protocol sniffing on a shared port
+	if err := tp.conn.SendKeepalive(); err != nil {
+		logging.Error("keepalive: %v", err)
+	}
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 	for {